@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// getLastDate returns the latest YYYYMMDD folder under the prefix in the store
+func getLastDate(store ObjectStore, prefix string) (string, error) {
+	folders, err := store.ListFolders(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	lastDate := ""
+	for _, folder := range folders {
+		if _, err := time.Parse("20060102", folder); err != nil {
+			continue
+		}
+		if folder > lastDate {
+			lastDate = folder
+		}
+	}
+
+	if lastDate == "" {
+		return "", errors.New("Could not find dates under: " + prefix)
+	}
+	return lastDate, nil
+}
+
+// getAutoDateRange works out the report days to generate:
+// from - the day after the last published hh_count report for the window,
+// to - the last day having daysAfter days of raw data after it
+// ok is false if there is nothing to do
+func getAutoDateRange(source, reports ObjectStore, prefix string, daysAfter int) (from, to string, ok bool, err error) {
+	// last raw downloaded to daap date from cdw
+	lastRaw, err := getLastDate(source, prefix)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	// last daap aggregated (hh) report generated date
+	lastAggregated, err := getLastDate(reports, formatPublishFolder(hhCountFolder, daysAfter))
+	if err != nil {
+		return "", "", false, err
+	}
+
+	if verbose {
+		log.Printf("Last raw date: %s, last aggregated date: %s\n", lastRaw, lastAggregated)
+	}
+
+	dtRaw, _ := time.Parse("20060102", lastRaw)
+	dtAggregated, _ := time.Parse("20060102", lastAggregated)
+
+	dtFrom := dtAggregated.AddDate(0, 0, 1)
+	dtTo := dtRaw.AddDate(0, 0, -daysAfter)
+
+	from = dtFrom.Format("20060102")
+	to = dtTo.Format("20060102")
+
+	return from, to, !dtFrom.After(dtTo), nil
+}
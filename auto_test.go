@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestGetAutoDateRange checks the range is from the day after the last published to the last day
+// having daysAfter days of raw files after it
+func TestGetAutoDateRange(t *testing.T) {
+	defer func(folder string) { hhCountFolder = folder }(hhCountFolder)
+	hhCountFolder = "hh_count"
+
+	tests := []struct {
+		name      string
+		raw       []string
+		published []string
+		daysAfter int
+		from, to  string
+		ok        bool
+	}{
+		{"late raw files", []string{"20160601", "20160605", "20160606"}, []string{"20160601", "20160602"}, 2, "20160603", "20160604", true},
+		{"one day", []string{"20160605"}, []string{"20160602"}, 2, "20160603", "20160603", true},
+		{"up to date", []string{"20160605"}, []string{"20160603"}, 2, "20160604", "20160603", false},
+		{"not dates ignored", []string{"20160605", "backup", "2016-06-09"}, []string{"20160601", "latest"}, 1, "20160602", "20160604", true},
+	}
+
+	for _, test := range tests {
+		files := make(map[string]string)
+		for _, date := range test.raw {
+			files["raw/"+date+"/htc/a.csv.gz"] = "a"
+		}
+		for _, date := range test.published {
+			files[formatPublishFolder("hh_count", test.daysAfter)+"/"+date+"/hh_count_htc_"+date+".csv"] = "a"
+		}
+		store := newTestStore(t, files)
+
+		from, to, ok, err := getAutoDateRange(store, store, "raw", test.daysAfter)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if from != test.from || to != test.to || ok != test.ok {
+			t.Errorf("%s: %s - %s, %v, expected %s - %s, %v", test.name, from, to, ok, test.from, test.to, test.ok)
+		}
+	}
+
+	// nothing published yet
+	store := newTestStore(t, map[string]string{"raw/20160605/htc/a.csv.gz": "a"})
+	if _, _, _, err := getAutoDateRange(store, store, "raw", 2); err == nil {
+		t.Error("no published dates: expected error")
+	}
+}
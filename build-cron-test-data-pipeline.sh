@@ -14,15 +14,6 @@ rc=$?; if [[ $rc != 0 ]]; then
 	exit $rc; 
 fi
 
-echo "Build precondition"
-GOOS=linux go build -v github.com/gevgev/precondition
-
-rc=$?; if [[ $rc != 0 ]]; then 
-	echo "Build failed: precondition"
-	cd ..
-	exit $rc; 
-fi
-
 echo "Copying script and mso list"
 cp ../run-aggregated-viewership-ubuntu-test-cron.sh run.sh
 cp ../mso-list-full.csv mso-list.csv
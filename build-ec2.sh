@@ -6,19 +6,15 @@ mkdir build-ec2
 cd build-ec2/
 
 echo "Build viewership-aggregator"
-GOOS=linux go build -v github.com/gevgev/viewership-aggregator
-
-rc=$?; if [[ $rc != 0 ]]; then 
-	echo "Build failed: viewership-aggregator"
-	cd ..
-	exit $rc; 
+# -db needs the SQLite driver built with cgo, on a Linux host: SQLITE=1 ./build-ec2.sh
+if [ "$SQLITE" = "1" ]; then
+	CGO_ENABLED=1 GOOS=linux go build -v -tags sqlite github.com/gevgev/viewership-aggregator
+else
+	GOOS=linux go build -v github.com/gevgev/viewership-aggregator
 fi
 
-echo "Build precondition"
-GOOS=linux go build -v github.com/gevgev/precondition
-
 rc=$?; if [[ $rc != 0 ]]; then 
-	echo "Build failed: precondition"
+	echo "Build failed: viewership-aggregator"
 	cd ..
 	exit $rc; 
 fi
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/csv"
+	"path/filepath"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// columnAliases maps MSO name to its column names: report column -> column name in the MSO's files
+var columnAliases map[string]map[string]string
+
+// getMsoFromPath returns the MSO name of the file: cdw_viewership_reports/<date>/<mso>/<file>
+func getMsoFromPath(fileName string) string {
+	return filepath.Base(filepath.Dir(fileName))
+}
+
+// readColumnMap reads the header of the file and maps its columns, using the aliases of the file's MSO
+func readColumnMap(r *csv.Reader, fileName string) (*viewership.ColumnMap, error) {
+	return viewership.ReadColumnMap(r, columnAliases[getMsoFromPath(fileName)])
+}
+
+// readOptions returns the options for reading the viewership files:
+// the MSO's column aliases, and the quarantine for the rejected rows
+func readOptions() viewership.Options {
+	return viewership.Options{
+		ColumnAliases: columnAliases,
+		Rejecter:      quarantine,
+		Verbose:       verbose,
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// command is a single stage of the pipeline, run as `viewership-aggregator <name> [flags]`
+// All the stages take their inputs from and write their outputs into the working directory:
+// cdw_viewership_reports/<date>/<mso>/ for the raw files, aggregated_viewership_<date>.csv
+// and hh_count_<mso>_<date>.csv for the reports
+type command struct {
+	name        string
+	description string
+	run         func(dateRange []string) error
+}
+
+var commands = []command{
+	{"download", "download the raw files for the dates range", runDownload},
+	{"sort", "sort the downloaded files for the merge", runSort},
+	{"aggregate", "merge the sorted files into aggregated_viewership reports, sessions with -s, ratings with -qh", runAggregate},
+	{"hhcount", "count the unique households and devices into hh_count, device_count and program_reach reports", runHHCount},
+	{"publish", "publish the reports into the reports bucket", runPublish},
+	{"reach", "count the unique households over the rolling 7 and 28 days and the range from the published hh sets", runReach},
+	{"run", "download, sort, aggregate and count; publish with -P", runAll},
+	{"update", "download the new or changed raw files and regenerate only the report days reading them; publish with -P", runUpdate},
+}
+
+func main() {
+	appName = os.Args[0]
+	args := os.Args[1:]
+
+	// the flags only (previous versions) means run all
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "config" {
+		runConfigCommand(args)
+		return
+	}
+
+	cmd, ok := findCommand(name)
+	if !ok {
+		log.Printf("Unknown command: %s\n", name)
+		usage(nil)
+	}
+
+	startTime := time.Now()
+
+	dateRange, ok := setup(cmd, args)
+	if !ok {
+		return
+	}
+
+	quarantine.SetDir(quarantineDir)
+	err := cmd.run(dateRange)
+
+	if rejected := quarantine.Close(quarantineReportFile); rejected > 0 {
+		log.Printf("Rejected %d rows, see %s and %s\n", rejected, quarantineReportFile, quarantineDir)
+	}
+
+	if err != nil {
+		log.Printf("%s failed: %s\n", cmd.name, err)
+		os.Exit(-1)
+	}
+
+	log.Printf("%s: processed %d MSO's, %d days, in %v\n", cmd.name, len(msoList), len(dateRange), time.Since(startTime))
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// registerFlags binds the run parameters to the flags of the command
+func registerFlags(flags *flag.FlagSet) (flagDateFrom, flagDateTo *string, flagHelp *bool) {
+	flags.StringVar(&regionName, "r", "us-west-2", "`AWS Region`")
+	flags.StringVar(&bucketName, "b", "daaprawcdwdata", "`Bucket name`")
+	flags.StringVar(&prefix, "p", "cdw_viewership_reports", "`Prefix` for the objecst in the bucket")
+	flags.StringVar(&localDir, "l", "", "`Local directory` to read the objects from instead of AWS S3")
+	flagDateFrom = flags.String("from", formatDefaultDate(), "`Date from`")
+	flagDateTo = flags.String("to", formatDefaultDate(), "`Date to`")
+	flags.StringVar(&msoListFilename, "m", "mso-list.csv", "Filename for `MSO` list")
+	flags.IntVar(&maxAttempts, "M", MAXATTEMPTS, "`Max attempts` to retry download from aws.s3")
+	flags.IntVar(&concurrency, "c", 10, "The number of files to process `concurrent`ly")
+	flags.IntVar(&sortMemory, "S", 512, "Max `MB` of memory to use for sorting a single file before spilling to disk, at least 1")
+	flags.IntVar(&daysAfter, "d", 2, "The number of days to go back for the report, at least 1")
+	flags.IntVar(&dayConcurrency, "w", runtime.NumCPU(), "The number of report days to generate concurrently (`workers`)")
+	flags.IntVar(&dayMemory, "W", 1024, "Estimated `MB` of memory per report day worker, limits the workers to the available memory (0 - no limit)")
+	flags.BoolVar(&dedup, "D", false, "Drop the duplicate events re-sent in the overlapping daily files, counts in duplicates_<date>.csv")
+	flags.BoolVar(&sessions, "s", false, "Build the viewing sessions into sessions_<date>.csv (aggregate)")
+	flags.DurationVar(&sessionIdleTimeout, "si", 30*time.Minute, "Session `idle timeout`: the device's session ends this long after its last event if no events since")
+	flags.DurationVar(&sessionMaxLength, "sm", 4*time.Hour, "Max session `length`, longer sessions are split (0 - no limit)")
+	flags.BoolVar(&ratings, "qh", false, "Quarter-hour channel ratings into quarter_hour_ratings_<date>.csv (aggregate), the tuning ends after -si idle")
+	flags.IntVar(&ratingsMinutes, "qm", 5, "Min `minutes` tuned in the quarter-hour for the household to count")
+	flags.StringVar(&outputFormat, "f", viewership.FormatCSV, "Aggregated viewership output `format`: "+strings.Join(viewership.Formats, ", "))
+	flags.IntVar(&rowGroupMB, "rg", 128, "Parquet row group size in `MB`")
+	flags.StringVar(&compression, "z", "snappy", "Parquet `compression`: snappy, gzip, zstd, lz4, none")
+	flags.StringVar(&sqliteDB, "db", "", "SQLite `database` file to also write the events and hh counts into, re-runs replace the report day (aggregate), only in the -tags sqlite build")
+	flags.BoolVar(&publish, "P", false, "Publish the reports into the reports bucket (run)")
+	flags.StringVar(&publishRegion, "R", "", "Reports `AWS Region`, -r if not provided")
+	flags.StringVar(&publishBucket, "B", "daapreports", "Reports `bucket name` to publish into")
+	flags.StringVar(&publishDir, "L", "", "`Local directory` to publish the reports into instead of AWS S3")
+	flags.StringVar(&viewerFolder, "vf", "viewership", "Published aggregated viewership `folder`, suffixed with the window: viewership2d")
+	flags.StringVar(&hhCountFolder, "hf", "hh_count", "Published hh count `folder`, suffixed with the window: hh_count2d")
+	flags.StringVar(&sessionsFolder, "sf", "sessions", "Published sessions `folder`, suffixed with the window: sessions2d")
+	flags.StringVar(&reachFolder, "pf", "program_reach", "Published program reach `folder`, suffixed with the window: program_reach2d")
+	flags.StringVar(&ratingsFolder, "rf", "quarter_hour_ratings", "Published quarter-hour ratings `folder`, suffixed with the window: quarter_hour_ratings2d")
+	flags.StringVar(&quarantineDir, "q", "quarantine", "`Folder` for the rejected rows of the input files")
+	flags.StringVar(&configFile, "config", "", "Config `file`, VA_CONFIG if not provided")
+	flags.BoolVar(&forceDownload, "force", false, "Download all the files again, ignoring the download manifest")
+	flags.BoolVar(&autoRange, "auto", false, "Find the dates range from the last raw and the last published dates, ignores -from/-to")
+	flagHelp = flags.Bool("h", false, "Help")
+	flags.BoolVar(&testRun, "t", false, "Test run to dump full csv as well")
+
+	flags.BoolVar(&verbose, "v", true, "`Verbose`: outputs to the screen")
+	return
+}
+
+// setup parses the flags of the command, loads MSO list, creates the stores and works out the dates range
+// ok is false if there is nothing to do
+func setup(cmd command, args []string) (dateRange []string, ok bool) {
+	flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	flagDateFrom, flagDateTo, flagHelp := registerFlags(flags)
+
+	flags.Parse(args)
+	if *flagHelp {
+		usage(flags)
+	}
+
+	// the parameters not on the command line come from the config file and the environment
+	if errs := configure(flags); len(errs) > 0 {
+		for _, e := range errs {
+			log.Println(e)
+		}
+		os.Exit(-1)
+	}
+
+	dateFrom = formatDate(*flagDateFrom)
+	dateTo = formatDate(*flagDateTo)
+
+	if verbose {
+		log.Printf("Provided From: %s, converted to %s\n", *flagDateFrom, dateFrom)
+		log.Printf("Provided To: %s, converted to %s\n", *flagDateTo, dateTo)
+	}
+
+	msoList, MSOLookup = getMsoNamesList()
+
+	if verbose {
+		PrintParams()
+	}
+
+	sourceStore = newObjectStore(localDir, regionName, bucketName)
+	if publishRegion == "" {
+		publishRegion = regionName
+	}
+	publishStore = newObjectStore(publishDir, publishRegion, publishBucket)
+
+	if autoRange {
+		from, to, ok, err := getAutoDateRange(sourceStore, publishStore, prefix, daysAfter)
+		if err != nil {
+			log.Println("Could not find dates: ", err)
+			os.Exit(-1)
+		}
+		if !ok {
+			log.Printf("Nothing to do: from %s is after to %s\n", from, to)
+			return nil, false
+		}
+		dateFrom, dateTo = from, to
+		log.Printf("Auto date range: from %s to %s\n", dateFrom, dateTo)
+	}
+
+	return getDateRange(dateFrom, dateTo, daysAfter), true
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Printf("%s, ver. %s\n", appName, version)
+	fmt.Println("Command line:")
+	fmt.Printf("\tprompt$>%s <command> -r <aws_region> -b <s3_bucket_name> -p <prefix> -l <local_dir> [-from <date> -to <date> | -auto] -d <days to aggregate> -S <sort_memory_mb> -w <day_workers> -W <day_memory_mb> -m <mso-list-file-name> -M <max_retry> [-force] [-D] [-s -si <idle_timeout> -sm <max_length>] [-qh -qm <min_minutes>] [-f csv|parquet|jsonl -rg <row_group_mb> -z <compression>] [-db <sqlite_file>] [-P -R <reports_region> -B <reports_bucket> -L <local_reports_dir>] [-config <file>]\n", appName)
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("\t%-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Printf("\t%-10s %s\n", "config", "validate -config <file>: report the errors in the config file")
+	if flags != nil {
+		flags.PrintDefaults()
+	}
+	os.Exit(-1)
+}
+
+// PrintParams prints out the parameters provided to the app
+func PrintParams() {
+	log.Printf("Provided: -r: %s, -b: %s, -p %s, -l %s, -from: %v, -to: %v, -d %d, -S %d, -w %d, -W %d, -m %s, -M %d, -force %v, -D %v, -s %v, -si %v, -sm %v, -qh %v, -qm %d, -f %s, -rg %d, -z %s, -db %s, -P %v, -R %s, -B %s, -L %s, -vf %s, -hf %s, -sf %s, -pf %s, -rf %s, -q %s, -config %s, -v: %v\n",
+		regionName,
+		bucketName,
+		prefix,
+		localDir,
+		dateFrom,
+		dateTo,
+		daysAfter,
+		sortMemory,
+		dayConcurrency,
+		dayMemory,
+		msoListFilename,
+		maxAttempts,
+		forceDownload,
+		dedup,
+		sessions,
+		sessionIdleTimeout,
+		sessionMaxLength,
+		ratings,
+		ratingsMinutes,
+		outputFormat,
+		rowGroupMB,
+		compression,
+		sqliteDB,
+		publish,
+		publishRegion,
+		publishBucket,
+		publishDir,
+		viewerFolder,
+		hhCountFolder,
+		sessionsFolder,
+		reachFolder,
+		ratingsFolder,
+		quarantineDir,
+		configFile,
+		verbose,
+	)
+}
+
+// ----------------------------------------------------------------------
+
+func runDownload(dateRange []string) error {
+	if _, failed := DownloadFiles(dateRange, false); len(failed) > 0 {
+		return fmt.Errorf("Failed downloading %d files", len(failed))
+	}
+	return nil
+}
+
+func runSort(dateRange []string) error {
+	if failed := SortFiles(dateRange); len(failed) > 0 {
+		return fmt.Errorf("Failed sorting %d files", len(failed))
+	}
+	return nil
+}
+
+func runAggregate(dateRange []string) error {
+	return reportFailedDays(GenerateDailyAggregatesMergeSort(dateFrom, dateRange, daysAfter, true, false))
+}
+
+func runHHCount(dateRange []string) error {
+	return reportFailedDays(GenerateDailyAggregatesMergeSort(dateFrom, dateRange, daysAfter, false, true))
+}
+
+// reportFailedDays returns the error listing the report days failed to generate, if any
+func reportFailedDays(failedDays []string) error {
+	if len(failedDays) > 0 {
+		return fmt.Errorf("Failed generating %d report days: %s", len(failedDays), strings.Join(failedDays, ", "))
+	}
+	return nil
+}
+
+func runPublish(dateRange []string) error {
+	log.Println("Publishing the reports")
+	return PublishReports(publishStore, viewership.ReportDays(dateFrom, dateRange, daysAfter), daysAfter)
+}
+
+// runAll downloads and sorts the files in one go, then aggregates and counts in one pass
+// Once generated, and published with -P, the downloaded files are marked regenerated in the download manifest for the update
+func runAll(dateRange []string) error {
+	// failed downloads are reported, the reports are generated from what's available
+	_, failed := DownloadFiles(dateRange, true)
+
+	failedDays := GenerateDailyAggregatesMergeSort(dateFrom, dateRange, daysAfter, true, true)
+
+	if publish {
+		if err := runPublish(dateRange); err != nil {
+			return errors.New("Error publishing the reports: " + err.Error())
+		}
+	}
+
+	manifest := LoadManifest(manifestFileName)
+	regenerated := make(map[string]bool)
+	for _, reportDay := range viewership.ReportDays(dateFrom, dateRange, daysAfter) {
+		regenerated[reportDay] = true
+	}
+	for _, reportDay := range failedDays {
+		regenerated[reportDay] = false
+	}
+	if err := markRegenerated(manifest, manifest.Keys(), dateRange, regenerated, failed); err != nil {
+		log.Println("Could not save download manifest: ", err)
+	}
+	return reportFailedDays(failedDays)
+}
+
+// runUpdate regenerates only the report days -from/-to reading the raw files new or changed since the report days
+// were last regenerated: it downloads the changed files, as per their ETag and size in the download manifest,
+// then the unchanged files of the affected report days missing on disk, as the runs remove them,
+// regenerates the affected report days and publishes them with -P
+// The files are marked regenerated in the manifest only once all their report days are regenerated, and published
+// with -P, so the report days failed to generate or publish, or reading a file failed to download, are left for the next update
+func runUpdate(dateRange []string) error {
+	manifest := LoadManifest(manifestFileName)
+	objects := listSourceFiles(dateRange)
+
+	changed := []ObjectInfo{}
+	for _, object := range objects {
+		if forceDownload || manifest.IsChanged(object) {
+			changed = append(changed, object)
+		}
+	}
+	_, failed := downloadObjects(changed, manifest, true)
+
+	// the files changed now, or by an earlier update not completed
+	pendingKeys := []string{}
+	pendingDates := []string{}
+	for _, object := range objects {
+		if forceDownload || !manifest.IsRegenerated(object.Key) {
+			pendingKeys = append(pendingKeys, object.Key)
+			pendingDates = append(pendingDates, sourceKeyDate(object.Key))
+		}
+	}
+
+	allReportDays := viewership.ReportDays(dateFrom, dateRange, daysAfter)
+	affectedDays := viewership.AffectedReportDays(allReportDays, pendingDates, daysAfter)
+
+	// the unchanged files read by the affected report days, not on disk anymore
+	missing := []ObjectInfo{}
+	for _, object := range objects {
+		if manifest.IsChanged(object) || manifest.IsDownloaded(object) {
+			continue
+		}
+		if len(viewership.AffectedReportDays(affectedDays, []string{sourceKeyDate(object.Key)}, daysAfter)) > 0 {
+			missing = append(missing, object)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("Downloading %d unchanged files of the affected report days\n", len(missing))
+		_, failedMissing := downloadObjects(missing, manifest, true)
+		failed = append(failed, failedMissing...)
+	}
+
+	affected := make(map[string]bool)
+	for _, reportDay := range affectedDays {
+		affected[reportDay] = true
+	}
+	failedDates := []string{}
+	for _, key := range failed {
+		failedDates = append(failedDates, sourceKeyDate(key))
+	}
+	for _, reportDay := range viewership.AffectedReportDays(affectedDays, failedDates, daysAfter) {
+		log.Printf("Not regenerating %s, its raw files failed to download\n", reportDay)
+		affected[reportDay] = false
+	}
+
+	reportDays := []string{}
+	reportIndexes := []int{}
+	for _, i := range viewership.ReportDayIndexes(dateFrom, dateRange, daysAfter) {
+		if affected[dateRange[i]] {
+			reportDays = append(reportDays, dateRange[i])
+			reportIndexes = append(reportIndexes, i)
+		}
+	}
+
+	failedDays := []string{}
+	if len(reportDays) == 0 {
+		log.Println("No report days to regenerate")
+	} else {
+		log.Printf("Regenerating %d report days: %s\n", len(reportDays), strings.Join(reportDays, ", "))
+		failedDays = generateReportDays(dateRange, reportIndexes, daysAfter, true, true)
+
+		regenerated := make(map[string]bool)
+		published := []string{}
+		for _, reportDay := range reportDays {
+			regenerated[reportDay] = true
+		}
+		for _, reportDay := range failedDays {
+			regenerated[reportDay] = false
+		}
+		for _, reportDay := range reportDays {
+			if regenerated[reportDay] {
+				published = append(published, reportDay)
+			}
+		}
+
+		if publish && len(published) > 0 {
+			if err := PublishReports(publishStore, published, daysAfter); err != nil {
+				return errors.New("Error publishing the reports: " + err.Error())
+			}
+		}
+		if err := markRegenerated(manifest, pendingKeys, dateRange, regenerated, nil); err != nil {
+			log.Println("Could not save download manifest: ", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed downloading %d files", len(failed))
+	}
+	return reportFailedDays(failedDays)
+}
+
+// markRegenerated marks the downloaded files regenerated in the manifest if all the report days
+// of the range reading them are regenerated, and the files failed to download not regenerated,
+// as the report days reading them are generated without them
+func markRegenerated(manifest *Manifest, keys, dateRange []string, regenerated map[string]bool, failed []string) error {
+	allReportDays := viewership.ReportDays(dateFrom, dateRange, daysAfter)
+
+	failedDates := []string{}
+	for _, key := range failed {
+		failedDates = append(failedDates, sourceKeyDate(key))
+	}
+	for _, reportDay := range viewership.AffectedReportDays(allReportDays, failedDates, daysAfter) {
+		regenerated[reportDay] = false
+	}
+
+	done := []string{}
+	for _, key := range keys {
+		reportDays := viewership.AffectedReportDays(allReportDays, []string{sourceKeyDate(key)}, daysAfter)
+		complete := len(reportDays) > 0
+		for _, reportDay := range reportDays {
+			complete = complete && regenerated[reportDay]
+		}
+		if complete {
+			done = append(done, key)
+		}
+	}
+
+	if err := manifest.SetRegenerated(failed, false); err != nil {
+		return err
+	}
+	return manifest.SetRegenerated(done, true)
+}
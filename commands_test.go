@@ -0,0 +1,312 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// testPipeline is the pipeline run by the tests in a temporary working directory,
+// reading the raw files from the source directory and publishing into the reports directory
+type testPipeline struct {
+	t       *testing.T
+	work    string
+	source  string
+	reports string
+}
+
+// newTestPipeline creates the working, source and reports directories with the MSO list: code, name pairs,
+// and changes into the working directory until the end of the test
+func newTestPipeline(t *testing.T, msos ...MsoType) *testPipeline {
+	t.Helper()
+	pipeline := &testPipeline{
+		t:       t,
+		work:    t.TempDir(),
+		source:  t.TempDir(),
+		reports: t.TempDir(),
+	}
+
+	content := ""
+	for _, mso := range msos {
+		content += mso.Code + "," + mso.Name + "\n"
+	}
+	writeTestFile(t, filepath.Join(pipeline.work, "mso-list.csv"), content)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(pipeline.work); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	// the state left by the other tests
+	configMsos = nil
+	columnAliases = nil
+	quarantine = NewQuarantine("quarantine")
+	return pipeline
+}
+
+// rawKey returns the source key of the MSO's raw file for the date
+func rawKey(mso, date string) string {
+	return "cdw_viewership_reports/" + date + "/" + mso + "/tv_viewership_" + mso + "_" + date + ".csv.gz"
+}
+
+// addRawFile writes the MSO's gzipped raw file for the date into the source directory,
+// the rows in the report columns order
+func (pipeline *testPipeline) addRawFile(mso, date string, rows ...string) string {
+	pipeline.t.Helper()
+	fileName := filepath.Join(pipeline.source, filepath.FromSlash(rawKey(mso, date)))
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		pipeline.t.Fatal(err)
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		pipeline.t.Fatal(err)
+	}
+	defer file.Close()
+
+	zipWriter := gzip.NewWriter(file)
+	zipWriter.Write([]byte(strings.Join(append([]string{strings.Join(viewership.Columns, ",")}, rows...), "\n") + "\n"))
+	if err := zipWriter.Close(); err != nil {
+		pipeline.t.Fatal(err)
+	}
+	return fileName
+}
+
+// setup parses the args of the command as main does, reading from the source and publishing into the reports directory
+func (pipeline *testPipeline) setup(name string, args ...string) (command, []string) {
+	pipeline.t.Helper()
+	cmd, ok := findCommand(name)
+	if !ok {
+		pipeline.t.Fatalf("unknown command %s", name)
+	}
+
+	args = append([]string{"-l", pipeline.source, "-L", pipeline.reports, "-v=false"}, args...)
+	dateRange, ok := setup(cmd, args)
+	if !ok {
+		pipeline.t.Fatalf("%s %v: nothing to do", name, args)
+	}
+	return cmd, dateRange
+}
+
+// run runs the command as main does
+func (pipeline *testPipeline) run(name string, args ...string) error {
+	pipeline.t.Helper()
+	cmd, dateRange := pipeline.setup(name, args...)
+
+	quarantine.SetDir(quarantineDir)
+	err := cmd.run(dateRange)
+	quarantine.Close(quarantineReportFile)
+	return err
+}
+
+// addRawFiles writes the raw files of the MSO's for the dates with the rows random but the same for the same
+// MSO and date: the events of the date, and some late events of the day before, so the files need sorting
+func (pipeline *testPipeline) addRawFiles(msos []string, dates []string, rows int) {
+	pipeline.t.Helper()
+	for _, mso := range msos {
+		for _, date := range dates {
+			day, err := time.Parse("20060102", date)
+			if err != nil {
+				pipeline.t.Fatal(err)
+			}
+			random := rand.New(rand.NewSource(int64(len(mso)) + day.Unix()))
+
+			lines := []string{}
+			for i := 0; i < rows; i++ {
+				ts := day.Add(time.Duration(i*24*3600/rows) * time.Second)
+				if i%10 == 0 {
+					// delivered late, in the next day's file
+					ts = ts.Add(-24 * time.Hour)
+				}
+				hh := 1 + random.Intn(30)
+				channel := 1 + random.Intn(5)
+				lines = append(lines, fmt.Sprintf("%d,%d-%d,watch,%s,%d00,\"Show %d\",%d,CH%d,79081,USA",
+					hh, hh, 1+random.Intn(2), ts.Format(viewership.TimestampFormat), channel, channel, channel, channel))
+			}
+			pipeline.addRawFile(mso, date, lines...)
+		}
+	}
+}
+
+// reportFiles reads the report files in the working directory: file name -> content
+func (pipeline *testPipeline) reportFiles(pattern string) map[string]string {
+	pipeline.t.Helper()
+	fileNames, err := filepath.Glob(filepath.Join(pipeline.work, pattern))
+	if err != nil {
+		pipeline.t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, fileName := range fileNames {
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			pipeline.t.Fatal(err)
+		}
+		files[filepath.Base(fileName)] = string(content)
+	}
+	return files
+}
+
+// publishedFiles reads the published reports, gunzipped: key -> content
+func (pipeline *testPipeline) publishedFiles() map[string]string {
+	pipeline.t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(pipeline.reports, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(pipeline.reports, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(key)] = readPublished(pipeline.t, path)
+		return nil
+	})
+	if err != nil {
+		pipeline.t.Fatal(err)
+	}
+	return files
+}
+
+// TestStagedCommands checks the stages run one by one publish the same reports as run,
+// with the raw files under the nested prefix too
+func TestStagedCommands(t *testing.T) {
+	dates := []string{"20160531", "20160601", "20160602", "20160603", "20160604"}
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-02", "-d", "2"}
+
+	all := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"})
+	all.addRawFiles([]string{"htc", "hc"}, dates, 100)
+	if err := all.run("run", append(args, "-P")...); err != nil {
+		t.Fatal(err)
+	}
+	expected := all.publishedFiles()
+	if len(expected) == 0 {
+		t.Fatal("nothing published")
+	}
+
+	for _, prefix := range []string{"cdw_viewership_reports", "raw/viewership"} {
+		staged := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"})
+		staged.addRawFiles([]string{"htc", "hc"}, dates, 100)
+		if prefix != "cdw_viewership_reports" {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(staged.source, prefix)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(staged.source, "cdw_viewership_reports"), filepath.Join(staged.source, prefix)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{"download", "sort", "aggregate", "hhcount", "publish"} {
+			if err := staged.run(name, append(args, "-p", prefix)...); err != nil {
+				t.Fatalf("%s -p %s: %s", name, prefix, err)
+			}
+		}
+
+		published := staged.publishedFiles()
+		if len(published) != len(expected) {
+			t.Errorf("-p %s: staged published %d files, run %d", prefix, len(published), len(expected))
+		}
+		for key, content := range expected {
+			if published[key] != content {
+				t.Errorf("-p %s: %s published by the stages differs", prefix, key)
+			}
+		}
+	}
+}
+
+// TestUpdate checks update regenerates only the report days reading the files changed since they were generated by run,
+// the unchanged files of those days removed from disk, or the files of the report days failed before,
+// and generates them the same as run
+func TestUpdate(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"})
+	dates := []string{"20160531", "20160601", "20160602", "20160603", "20160604"}
+	pipeline.addRawFiles([]string{"htc"}, dates, 50)
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-03", "-d", "1"}
+
+	if err := pipeline.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	manifest := LoadManifest(manifestFileName)
+	for _, date := range dates {
+		if !manifest.IsRegenerated(rawKey("htc", date)) {
+			t.Errorf("%s not marked regenerated by run without -P", date)
+		}
+	}
+
+	// update returns the report days it regenerated, after checking they are the same as run generates
+	update := func() []string {
+		t.Helper()
+		fileNames, _ := filepath.Glob(filepath.Join(pipeline.work, "aggregated_viewership_*.csv"))
+		for _, fileName := range fileNames {
+			os.Remove(fileName)
+		}
+		if err := pipeline.run("update", args...); err != nil {
+			t.Fatal(err)
+		}
+		updated := pipeline.reportFiles("aggregated_viewership_*.csv")
+
+		if err := pipeline.run("run", args...); err != nil {
+			t.Fatal(err)
+		}
+		expected := pipeline.reportFiles("aggregated_viewership_*.csv")
+		reportDays := []string{}
+		for fileName, content := range updated {
+			if expected[fileName] != content {
+				t.Errorf("%s regenerated by update differs from run", fileName)
+			}
+			reportDays = append(reportDays, strings.TrimSuffix(strings.TrimPrefix(fileName, "aggregated_viewership_"), ".csv"))
+		}
+		sort.Strings(reportDays)
+		return reportDays
+	}
+
+	tests := []struct {
+		name     string
+		change   func()
+		expected []string
+	}{
+		{"unchanged", func() {}, []string{}},
+		{"changed", func() {
+			pipeline.addRawFile("htc", "20160603", "1,1-1,watch,2016-06-03 10:00:00,100,Show,4,CH4,79081,USA")
+		}, []string{"20160602", "20160603"}},
+		{"missing on disk", func() {
+			pipeline.addRawFile("htc", "20160604", "1,1-1,watch,2016-06-03 22:00:00,100,Show,4,CH4,79081,USA")
+			// read by 20160603 with the changed file, not changed itself
+			if err := os.Remove(LoadManifest(manifestFileName).Path(rawKey("htc", "20160602"))); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"20160603"}},
+		{"failed before", func() {
+			if err := LoadManifest(manifestFileName).SetRegenerated([]string{rawKey("htc", "20160531")}, false); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"20160601"}},
+	}
+
+	for _, test := range tests {
+		test.change()
+		if reportDays := update(); !reflect.DeepEqual(reportDays, test.expected) {
+			t.Errorf("%s: update regenerated %v, expected %v", test.name, reportDays, test.expected)
+		}
+		manifest := LoadManifest(manifestFileName)
+		for _, date := range dates {
+			if !manifest.IsRegenerated(rawKey("htc", date)) {
+				t.Errorf("%s: %s not marked regenerated", test.name, date)
+			}
+		}
+	}
+}
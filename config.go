@@ -0,0 +1,459 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the run parameters file, any parameter not in the file keeps its flag default:
+//
+//	source:
+//	  region: us-west-2
+//	  bucket: daaprawcdwdata
+//	  prefix: cdw_viewership_reports
+//	destination:
+//	  bucket: daapreports
+//	mso_list: mso-list.csv
+//	window:
+//	  days_after: 2
+type Config struct {
+	Source      StoreConfig    `yaml:"source"`
+	Destination StoreConfig    `yaml:"destination"`
+	MsoList     string         `yaml:"mso_list"`
+	Msos        []MsoType      `yaml:"msos"`
+	Window      WindowConfig   `yaml:"window"`
+	Download    DownloadConfig `yaml:"download"`
+	Processing  ProcessConfig  `yaml:"processing"`
+	Sessions    SessionsConfig `yaml:"sessions"`
+	Ratings     RatingsConfig  `yaml:"ratings"`
+	Output      OutputConfig   `yaml:"output"`
+	Verbose     *bool          `yaml:"verbose"`
+	// ColumnAliases maps MSO name to its column names: report column -> column name in the MSO's files
+	ColumnAliases map[string]map[string]string `yaml:"column_aliases"`
+}
+
+// StoreConfig is the S3 bucket, or the local directory instead of it
+type StoreConfig struct {
+	Region string `yaml:"region"`
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+	Dir    string `yaml:"dir"`
+}
+
+// WindowConfig is the report days and the number of days after each to aggregate
+type WindowConfig struct {
+	From      string `yaml:"from"`
+	To        string `yaml:"to"`
+	Auto      *bool  `yaml:"auto"`
+	DaysAfter *int   `yaml:"days_after"`
+}
+
+// DownloadConfig is the download parameters
+type DownloadConfig struct {
+	Concurrency *int `yaml:"concurrency"`
+	MaxAttempts *int `yaml:"max_attempts"`
+}
+
+// ProcessConfig is the sort/merge parameters
+type ProcessConfig struct {
+	SortMemory *int  `yaml:"sort_memory"`
+	DayWorkers *int  `yaml:"day_workers"`
+	DayMemory  *int  `yaml:"day_memory"`
+	Dedup      *bool `yaml:"dedup"`
+}
+
+// SessionsConfig is the sessionization parameters, the durations as 30m, 4h
+type SessionsConfig struct {
+	Enabled     *bool  `yaml:"enabled"`
+	IdleTimeout string `yaml:"idle_timeout"`
+	MaxLength   string `yaml:"max_length"`
+}
+
+// RatingsConfig is the quarter-hour channel ratings parameters
+type RatingsConfig struct {
+	Enabled    *bool `yaml:"enabled"`
+	MinMinutes *int  `yaml:"min_minutes"`
+}
+
+// OutputConfig is the format and the layout of the published reports
+type OutputConfig struct {
+	Format           string `yaml:"format"`
+	RowGroupMB       *int   `yaml:"row_group_mb"`
+	Compression      string `yaml:"compression"`
+	SQLiteDB         string `yaml:"sqlite_db"`
+	Publish          *bool  `yaml:"publish"`
+	ViewershipFolder string `yaml:"viewership_folder"`
+	HHCountFolder    string `yaml:"hh_count_folder"`
+	SessionsFolder   string `yaml:"sessions_folder"`
+	ReachFolder      string `yaml:"program_reach_folder"`
+	RatingsFolder    string `yaml:"ratings_folder"`
+	QuarantineDir    string `yaml:"quarantine_dir"`
+}
+
+// configParam binds a flag to its environment variable and its value in the config file
+type configParam struct {
+	flag  string
+	env   string
+	value func(cfg *Config) string
+}
+
+func intValue(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+func boolValue(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+var configParams = []configParam{
+	{"r", "VA_REGION", func(cfg *Config) string { return cfg.Source.Region }},
+	{"b", "VA_SOURCE_BUCKET", func(cfg *Config) string { return cfg.Source.Bucket }},
+	{"p", "VA_SOURCE_PREFIX", func(cfg *Config) string { return cfg.Source.Prefix }},
+	{"l", "VA_SOURCE_DIR", func(cfg *Config) string { return cfg.Source.Dir }},
+	{"R", "VA_DESTINATION_REGION", func(cfg *Config) string { return cfg.Destination.Region }},
+	{"B", "VA_DESTINATION_BUCKET", func(cfg *Config) string { return cfg.Destination.Bucket }},
+	{"L", "VA_DESTINATION_DIR", func(cfg *Config) string { return cfg.Destination.Dir }},
+	{"m", "VA_MSO_LIST", func(cfg *Config) string { return cfg.MsoList }},
+	{"from", "VA_FROM", func(cfg *Config) string { return cfg.Window.From }},
+	{"to", "VA_TO", func(cfg *Config) string { return cfg.Window.To }},
+	{"auto", "VA_AUTO", func(cfg *Config) string { return boolValue(cfg.Window.Auto) }},
+	{"d", "VA_DAYS_AFTER", func(cfg *Config) string { return intValue(cfg.Window.DaysAfter) }},
+	{"c", "VA_CONCURRENCY", func(cfg *Config) string { return intValue(cfg.Download.Concurrency) }},
+	{"M", "VA_MAX_ATTEMPTS", func(cfg *Config) string { return intValue(cfg.Download.MaxAttempts) }},
+	{"S", "VA_SORT_MEMORY", func(cfg *Config) string { return intValue(cfg.Processing.SortMemory) }},
+	{"w", "VA_DAY_WORKERS", func(cfg *Config) string { return intValue(cfg.Processing.DayWorkers) }},
+	{"W", "VA_DAY_MEMORY", func(cfg *Config) string { return intValue(cfg.Processing.DayMemory) }},
+	{"D", "VA_DEDUP", func(cfg *Config) string { return boolValue(cfg.Processing.Dedup) }},
+	{"s", "VA_SESSIONS", func(cfg *Config) string { return boolValue(cfg.Sessions.Enabled) }},
+	{"si", "VA_SESSION_IDLE_TIMEOUT", func(cfg *Config) string { return cfg.Sessions.IdleTimeout }},
+	{"sm", "VA_SESSION_MAX_LENGTH", func(cfg *Config) string { return cfg.Sessions.MaxLength }},
+	{"qh", "VA_RATINGS", func(cfg *Config) string { return boolValue(cfg.Ratings.Enabled) }},
+	{"qm", "VA_RATINGS_MIN_MINUTES", func(cfg *Config) string { return intValue(cfg.Ratings.MinMinutes) }},
+	{"f", "VA_FORMAT", func(cfg *Config) string { return cfg.Output.Format }},
+	{"rg", "VA_ROW_GROUP_MB", func(cfg *Config) string { return intValue(cfg.Output.RowGroupMB) }},
+	{"z", "VA_COMPRESSION", func(cfg *Config) string { return cfg.Output.Compression }},
+	{"db", "VA_SQLITE_DB", func(cfg *Config) string { return cfg.Output.SQLiteDB }},
+	{"P", "VA_PUBLISH", func(cfg *Config) string { return boolValue(cfg.Output.Publish) }},
+	{"vf", "VA_VIEWERSHIP_FOLDER", func(cfg *Config) string { return cfg.Output.ViewershipFolder }},
+	{"hf", "VA_HH_COUNT_FOLDER", func(cfg *Config) string { return cfg.Output.HHCountFolder }},
+	{"sf", "VA_SESSIONS_FOLDER", func(cfg *Config) string { return cfg.Output.SessionsFolder }},
+	{"pf", "VA_PROGRAM_REACH_FOLDER", func(cfg *Config) string { return cfg.Output.ReachFolder }},
+	{"rf", "VA_RATINGS_FOLDER", func(cfg *Config) string { return cfg.Output.RatingsFolder }},
+	{"q", "VA_QUARANTINE_DIR", func(cfg *Config) string { return cfg.Output.QuarantineDir }},
+	{"v", "VA_VERBOSE", func(cfg *Config) string { return boolValue(cfg.Verbose) }},
+}
+
+// LoadConfig reads the config file, unknown keys are errors
+func LoadConfig(fileName string) (*Config, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("Could not parse config file: %s, Error: %s", fileName, err)
+	}
+	return cfg, nil
+}
+
+// applyConfig sets the flags not provided on the command line:
+// first from the config file (if any), then from the environment variables
+func applyConfig(flags *flag.FlagSet, cfg *Config) error {
+	provided := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { provided[f.Name] = true })
+
+	for _, param := range configParams {
+		if provided[param.flag] {
+			continue
+		}
+
+		if cfg != nil {
+			if value := param.value(cfg); value != "" {
+				if err := flags.Set(param.flag, value); err != nil {
+					return fmt.Errorf("Invalid config value for %s: %s", param.flag, err)
+				}
+			}
+		}
+
+		if value, ok := os.LookupEnv(param.env); ok {
+			if err := flags.Set(param.flag, value); err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", param.env, err)
+			}
+		}
+	}
+
+	if cfg != nil {
+		columnAliases = cfg.ColumnAliases
+	}
+
+	// the MSO list in the config file replaces the MSO list file
+	if cfg != nil && len(cfg.Msos) > 0 && !provided["m"] {
+		if _, ok := os.LookupEnv("VA_MSO_LIST"); !ok {
+			configMsos = cfg.Msos
+		}
+	}
+	return nil
+}
+
+// validateFlags returns the errors in the final values of the flags, whether from the command line,
+// the config file or the environment, with the bounds of ValidateConfig
+func validateFlags(flags *flag.FlagSet) []string {
+	errs := []string{}
+
+	for _, bound := range numberBounds {
+		value, err := strconv.Atoi(flags.Lookup(bound.flag).Value.String())
+		if err == nil && value < bound.minValue {
+			errs = append(errs, fmt.Sprintf("-%s (%s) must be at least %d, got %d", bound.flag, bound.name, bound.minValue, value))
+		}
+	}
+	if value, err := strconv.Atoi(flags.Lookup("qm").Value.String()); err == nil && value > maxRatingsMinutes() {
+		errs = append(errs, fmt.Sprintf("-qm (ratings.min_minutes) must be at most %d, got %d", maxRatingsMinutes(), value))
+	}
+
+	for _, bound := range durationBounds {
+		value, err := time.ParseDuration(flags.Lookup(bound.flag).Value.String())
+		if err == nil && value < bound.minValue {
+			errs = append(errs, fmt.Sprintf("-%s (%s) must be at least %v, got %v", bound.flag, bound.name, bound.minValue, value))
+		}
+	}
+
+	if format := flags.Lookup("f").Value.String(); !isFormat(format) {
+		errs = append(errs, fmt.Sprintf("-f (output.format): unknown format %s, expected one of: %s", format, strings.Join(viewership.Formats, ", ")))
+	}
+	if compression := flags.Lookup("z").Value.String(); !viewership.IsParquetCompression(compression) {
+		errs = append(errs, fmt.Sprintf("-z (output.compression): unknown compression %s", compression))
+	}
+	if sqliteDB := flags.Lookup("db").Value.String(); sqliteDB != "" && !viewership.SQLiteSupported {
+		errs = append(errs, "-db (output.sqlite_db): SQLite is not supported by this build, rebuild with CGO_ENABLED=1 go build -tags sqlite")
+	}
+	return errs
+}
+
+// configure sets the flags not on the command line from the config file and the environment,
+// and returns the errors in the config file and in the final values
+func configure(flags *flag.FlagSet) []string {
+	var cfg *Config
+	if fileName := configFileName(configFile); fileName != "" {
+		var err error
+		if cfg, err = LoadConfig(fileName); err != nil {
+			return []string{err.Error()}
+		}
+		if errs := ValidateConfig(cfg); len(errs) > 0 {
+			for i := range errs {
+				errs[i] = fileName + ": " + errs[i]
+			}
+			return errs
+		}
+	}
+
+	if err := applyConfig(flags, cfg); err != nil {
+		return []string{err.Error()}
+	}
+	return validateFlags(flags)
+}
+
+// configFileName returns the config file from -config or VA_CONFIG
+func configFileName(flagConfig string) string {
+	if flagConfig != "" {
+		return flagConfig
+	}
+	return os.Getenv("VA_CONFIG")
+}
+
+// numberBound is the least value of a number parameter, the same in the config file, the environment and the flags
+type numberBound struct {
+	name     string
+	flag     string
+	minValue int
+	value    func(cfg *Config) *int
+}
+
+var numberBounds = []numberBound{
+	{"window.days_after", "d", 1, func(cfg *Config) *int { return cfg.Window.DaysAfter }},
+	{"download.concurrency", "c", 1, func(cfg *Config) *int { return cfg.Download.Concurrency }},
+	{"download.max_attempts", "M", 1, func(cfg *Config) *int { return cfg.Download.MaxAttempts }},
+	// with no memory, every row would be spilled into its own run
+	{"processing.sort_memory", "S", 1, func(cfg *Config) *int { return cfg.Processing.SortMemory }},
+	{"processing.day_workers", "w", 1, func(cfg *Config) *int { return cfg.Processing.DayWorkers }},
+	{"processing.day_memory", "W", 0, func(cfg *Config) *int { return cfg.Processing.DayMemory }},
+	{"ratings.min_minutes", "qm", 1, func(cfg *Config) *int { return cfg.Ratings.MinMinutes }},
+	{"output.row_group_mb", "rg", 1, func(cfg *Config) *int { return cfg.Output.RowGroupMB }},
+}
+
+// durationBound is the least value of a duration parameter, as numberBound
+type durationBound struct {
+	name     string
+	flag     string
+	minValue time.Duration
+	value    func(cfg *Config) string
+}
+
+var durationBounds = []durationBound{
+	{"sessions.idle_timeout", "si", time.Second, func(cfg *Config) string { return cfg.Sessions.IdleTimeout }},
+	{"sessions.max_length", "sm", 0, func(cfg *Config) string { return cfg.Sessions.MaxLength }},
+}
+
+// maxRatingsMinutes is the most minutes the household can be tuned in the quarter-hour
+func maxRatingsMinutes() int {
+	return int(viewership.QuarterHour / time.Minute)
+}
+
+// ValidateConfig returns all the errors found in the config
+func ValidateConfig(cfg *Config) []string {
+	errs := []string{}
+
+	if cfg.Source.Bucket != "" && cfg.Source.Dir != "" {
+		errs = append(errs, "source: only one of bucket or dir is allowed")
+	}
+	if cfg.Destination.Bucket != "" && cfg.Destination.Dir != "" {
+		errs = append(errs, "destination: only one of bucket or dir is allowed")
+	}
+	if strings.HasPrefix(cfg.Source.Prefix, "/") || strings.HasSuffix(cfg.Source.Prefix, "/") {
+		errs = append(errs, "source: prefix must not start or end with /")
+	}
+	if cfg.Destination.Prefix != "" {
+		errs = append(errs, "destination: prefix is not supported, use output folders")
+	}
+	if cfg.Source.Dir != "" {
+		if info, err := os.Stat(cfg.Source.Dir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("source: directory not found: %s", cfg.Source.Dir))
+		}
+	}
+
+	if len(cfg.Msos) > 0 {
+		names := make(map[string]bool)
+		for i, mso := range cfg.Msos {
+			if mso.Code == "" || mso.Name == "" {
+				errs = append(errs, fmt.Sprintf("msos[%d]: code and name are required", i))
+			}
+			if names[mso.Name] {
+				errs = append(errs, fmt.Sprintf("msos[%d]: duplicate name %s", i, mso.Name))
+			}
+			names[mso.Name] = true
+		}
+		if cfg.MsoList != "" {
+			errs = append(errs, "only one of mso_list or msos is allowed")
+		}
+	} else if cfg.MsoList != "" {
+		if _, err := os.Stat(cfg.MsoList); err != nil {
+			errs = append(errs, fmt.Sprintf("mso_list: %s", err))
+		}
+	}
+
+	for _, date := range []string{cfg.Window.From, cfg.Window.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("20060102", formatDate(date)); err != nil {
+			errs = append(errs, fmt.Sprintf("window: invalid date %s", date))
+		}
+	}
+	if cfg.Window.Auto != nil && *cfg.Window.Auto && (cfg.Window.From != "" || cfg.Window.To != "") {
+		errs = append(errs, "window: auto ignores from/to")
+	}
+
+	for _, bound := range numberBounds {
+		if value := bound.value(cfg); value != nil && *value < bound.minValue {
+			errs = append(errs, fmt.Sprintf("%s must be at least %d", bound.name, bound.minValue))
+		}
+	}
+	if cfg.Ratings.MinMinutes != nil && *cfg.Ratings.MinMinutes > maxRatingsMinutes() {
+		errs = append(errs, fmt.Sprintf("ratings.min_minutes must be at most %d", maxRatingsMinutes()))
+	}
+
+	for _, bound := range durationBounds {
+		value := bound.value(cfg)
+		if value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid duration %s", bound.name, value))
+		} else if duration < bound.minValue {
+			errs = append(errs, fmt.Sprintf("%s must be at least %v", bound.name, bound.minValue))
+		}
+	}
+
+	for mso, aliases := range cfg.ColumnAliases {
+		for column := range aliases {
+			if !viewership.IsReportColumn(column) {
+				errs = append(errs, fmt.Sprintf("column_aliases.%s: unknown column %s", mso, column))
+			}
+		}
+	}
+
+	if cfg.Output.Format != "" && !isFormat(cfg.Output.Format) {
+		errs = append(errs, fmt.Sprintf("output: unknown format %s, expected one of: %s", cfg.Output.Format, strings.Join(viewership.Formats, ", ")))
+	}
+	if cfg.Output.Compression != "" && !viewership.IsParquetCompression(cfg.Output.Compression) {
+		errs = append(errs, fmt.Sprintf("output: unknown compression %s", cfg.Output.Compression))
+	}
+
+	if strings.Contains(cfg.Output.ViewershipFolder, "/") || strings.Contains(cfg.Output.HHCountFolder, "/") ||
+		strings.Contains(cfg.Output.SessionsFolder, "/") || strings.Contains(cfg.Output.ReachFolder, "/") ||
+		strings.Contains(cfg.Output.RatingsFolder, "/") {
+		errs = append(errs, "output: folders must not contain /")
+	}
+
+	return errs
+}
+
+func isFormat(format string) bool {
+	for _, f := range viewership.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// runConfigCommand runs `config validate [-config <file>]`
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		log.Println("Usage: config validate -config <file>")
+		os.Exit(-1)
+	}
+
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	flagConfig := flags.String("config", "", "Config `file` to validate")
+	flags.Parse(args[1:])
+
+	fileName := configFileName(*flagConfig)
+	if fileName == "" && flags.NArg() > 0 {
+		fileName = flags.Arg(0)
+	}
+	if fileName == "" {
+		log.Println("No config file provided")
+		os.Exit(-1)
+	}
+
+	cfg, err := LoadConfig(fileName)
+	if err != nil {
+		log.Println(err)
+		os.Exit(-1)
+	}
+
+	errs := ValidateConfig(cfg)
+	for _, e := range errs {
+		fmt.Printf("%s: %s\n", fileName, e)
+	}
+	if len(errs) > 0 {
+		os.Exit(-1)
+	}
+	fmt.Printf("%s: OK\n", fileName)
+}
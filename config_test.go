@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// TestConfigPrecedence checks the config file is overridden by the environment, and both by the flags
+func TestConfigPrecedence(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"})
+	configFile := filepath.Join(pipeline.work, "config.yaml")
+	writeTestFile(t, configFile, `window:
+  days_after: 3
+download:
+  concurrency: 4
+  max_attempts: 2
+processing:
+  day_workers: 2
+sessions:
+  idle_timeout: 10m
+`)
+	t.Setenv("VA_CONCURRENCY", "5")
+	t.Setenv("VA_DAY_WORKERS", "6")
+	t.Setenv("VA_SESSION_IDLE_TIMEOUT", "20m")
+
+	pipeline.setup("aggregate", "-from", "2016-06-01", "-to", "2016-06-01", "-config", configFile, "-w", "7", "-M", "1")
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"-d from the file", daysAfter, 3},
+		{"-c from the environment over the file", concurrency, 5},
+		{"-M from the flag over the file", maxAttempts, 1},
+		{"-w from the flag over the environment", dayConcurrency, 7},
+		{"-si from the environment over the file", sessionIdleTimeout, 20 * time.Minute},
+		{"-S default", sortMemory, 512},
+	}
+	for _, test := range tests {
+		if test.value != test.expected {
+			t.Errorf("%s: %v, expected %v", test.name, test.value, test.expected)
+		}
+	}
+}
+
+// TestConfigure checks the config file, the environment and the flags are all held to the same bounds
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		config string
+		errs   []string
+	}{
+		{"defaults", nil, nil, "", nil},
+		{"-d 0", []string{"-d", "0"}, nil, "", []string{"-d (window.days_after) must be at least 1"}},
+		{"VA_DAYS_AFTER=0", nil, map[string]string{"VA_DAYS_AFTER": "0"}, "", []string{"-d (window.days_after) must be at least 1"}},
+		{"days_after: 0", nil, nil, "window:\n  days_after: 0\n", []string{"window.days_after must be at least 1"}},
+		{"day_workers: 0", nil, nil, "processing:\n  day_workers: 0\n", []string{"processing.day_workers must be at least 1"}},
+		{"-w 0", []string{"-w", "0"}, nil, "", []string{"-w (processing.day_workers) must be at least 1"}},
+		{"VA_SORT_MEMORY=0", nil, map[string]string{"VA_SORT_MEMORY": "0"}, "", []string{"-S (processing.sort_memory) must be at least 1"}},
+		{"idle_timeout: 30 minutes", nil, nil, "sessions:\n  idle_timeout: 30 minutes\n", []string{"sessions.idle_timeout: invalid duration 30 minutes"}},
+		{"-si 0s", []string{"-si", "0s"}, nil, "", []string{"-si (sessions.idle_timeout) must be at least 1s"}},
+		{"-qm 20", []string{"-qm", "20"}, nil, "", []string{"-qm (ratings.min_minutes) must be at most 15"}},
+		{"-f xml", []string{"-f", "xml"}, nil, "", []string{"-f (output.format): unknown format xml"}},
+		// the flag fixes the environment value
+		{"VA_DAYS_AFTER=0 -d 1", []string{"-d", "1"}, map[string]string{"VA_DAYS_AFTER": "0"}, "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			args := test.args
+			if test.config != "" {
+				configFile := filepath.Join(t.TempDir(), "config.yaml")
+				writeTestFile(t, configFile, test.config)
+				args = append([]string{"-config", configFile}, args...)
+			}
+
+			flags := flag.NewFlagSet(test.name, flag.ContinueOnError)
+			registerFlags(flags)
+			if err := flags.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			errs := configure(flags)
+			if len(errs) != len(test.errs) {
+				t.Fatalf("errors %v, expected %v", errs, test.errs)
+			}
+			for i := range errs {
+				if !strings.Contains(errs[i], test.errs[i]) {
+					t.Errorf("error %q, expected %q", errs[i], test.errs[i])
+				}
+			}
+		})
+	}
+}
+
+// TestConfigureSQLite checks -db is refused by the build without the SQLite driver
+func TestConfigureSQLite(t *testing.T) {
+	flags := flag.NewFlagSet("aggregate", flag.ContinueOnError)
+	registerFlags(flags)
+	if err := flags.Parse([]string{"-db", filepath.Join(t.TempDir(), "viewership.sqlite")}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := configure(flags)
+	if viewership.SQLiteSupported && len(errs) > 0 {
+		t.Errorf("errors %v with SQLite supported", errs)
+	}
+	if !viewership.SQLiteSupported && (len(errs) != 1 || !strings.Contains(errs[0], "-db")) {
+		t.Errorf("errors %v, expected -db not supported", errs)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// entryOverhead is the approximate memory taken by a ReportEntry besides its strings:
+// eight string headers, the timestamp, the channel number and its flag plus the slice slot
+const entryOverhead = 8*16 + 24 + 8 + 8 + 16
+
+// maxMergeRuns is the most sorted runs merged at once, each open run takes a file and a block of entries
+const maxMergeRuns = 64
+
+// entrySize estimates the memory taken by the entry in the sort buffer
+func entrySize(entry viewership.ReportEntry) int {
+	return entryOverhead +
+		len(entry.HHID) + len(entry.DeviceID) + len(entry.Event) + len(entry.ProgramID) +
+		len(entry.ProgramName) + len(entry.ChannelName) + len(entry.Zipcode) + len(entry.Country)
+}
+
+// sortedFileName returns the name of the sorted csv file for the downloaded .gz/.gzip file
+func sortedFileName(fileName string) string {
+	newFileName := ""
+	if strings.Contains(fileName, ".gzip") {
+		newFileName = strings.TrimSuffix(fileName, ".gzip")
+	} else if strings.Contains(fileName, ".gz") {
+		newFileName = strings.TrimSuffix(fileName, ".gz")
+	}
+	return newFileName
+}
+
+// SortFiles prepares the downloaded files in the working directory for the dates range for the merge,
+// processing up to concurrency files at a time, and records the sorted files in the download manifest
+// Returns the list of the files failed to sort
+func SortFiles(dateRange []string) []string {
+	fileNames := []string{}
+	for _, eachDate := range dateRange {
+		filepath.Walk(filepath.Join(prefix, eachDate), func(path string, f os.FileInfo, err error) error {
+			if err == nil && !f.IsDir() && viewership.IsGzipFile(path) {
+				fileNames = append(fileNames, path)
+			}
+			return nil
+		})
+	}
+
+	manifest := LoadManifest(manifestFileName)
+	sem := make(chan bool, concurrency)
+	failed := []string{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, fileName := range fileNames {
+		sem <- true
+		wg.Add(1)
+		go func(fileName string) {
+			defer func() { <-sem }()
+			defer wg.Done()
+
+			path, ok := prepareFile(fileName)
+			if !ok {
+				mutex.Lock()
+				failed = append(failed, fileName)
+				mutex.Unlock()
+				return
+			}
+
+			// the downloaded files are named by their keys
+			if err := manifest.SetPath(fileName, path); err != nil {
+				log.Println("Could not save download manifest: ", err)
+			}
+		}(fileName)
+	}
+	wg.Wait()
+
+	log.Printf("Sorted %d files, %d failed\n", len(fileNames)-len(failed), len(failed))
+	for _, fileName := range failed {
+		log.Println("Failed sorting: ", fileName)
+	}
+	return failed
+}
+
+// prepareFile makes the downloaded file ready for the merge:
+// the file already sorted by ts is left gzipped, to be read directly by viewership.FileStruct,
+// otherwise it is sorted into .csv, and the .gz is removed
+// Returns the file ready for the merge
+func prepareFile(fileName string) (string, bool) {
+	if isFileSorted(fileName) {
+		if verbose {
+			log.Println("Already sorted, keeping gzipped: ", fileName)
+		}
+		return fileName, true
+	}
+
+	if !unzipAndSortFile(fileName) {
+		return "", false
+	}
+
+	if err := os.Remove(fileName); err != nil {
+		log.Println("Could not remove sorted gzip file: ", err)
+	}
+	return sortedFileName(fileName), true
+}
+
+// isFileSorted streams through the gzipped file and checks if the entries are ordered by ts
+// The file with invalid rows is reported as not sorted, so the rows are quarantined while sorting
+func isFileSorted(fileName string) bool {
+	handle, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+	defer handle.Close()
+
+	zipReader, err := gzip.NewReader(handle)
+	if err != nil {
+		return false
+	}
+	defer zipReader.Close()
+
+	r := csv.NewReader(zipReader)
+	r.ReuseRecord = true
+
+	columns, err := readColumnMap(r, fileName)
+	if err != nil {
+		return false
+	}
+
+	var lastTs time.Time
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			return false
+		}
+
+		entry, err := columns.Entry(record)
+		if err != nil || entry.Timestamp.Before(lastTs) {
+			return false
+		}
+		lastTs = entry.Timestamp
+	}
+}
+
+// unzipAndSortFile unzips, sorts, and saves the original file, using sortMemory MB
+func unzipAndSortFile(fileName string) bool {
+	return sortFile(fileName, sortMemory*1024*1024, maxMergeRuns)
+}
+
+// sortFile unzips, sorts, and saves the original file, using bounded memory:
+// 1. reads the gzipped entries into the buffer until it reaches maxBufferSize bytes
+// 2. sorts the buffer and spills it as a sorted run next to the file
+// 3. merges the sorted runs using viewership.FilesPack into the resulting file, by maxRuns at once
+// If the whole file fits into the buffer, it is sorted and saved without any runs
+// The resulting file is removed if it could not be written completely
+func sortFile(fileName string, maxBufferSize, maxRuns int) bool {
+	// 1. unzip the file
+	handle, err := os.Open(fileName)
+	if err != nil {
+		log.Println("Error opening gzip file: ", err)
+		return false
+	}
+	defer handle.Close()
+
+	zipReader, err := gzip.NewReader(handle)
+	if err != nil {
+		log.Println("Error: ", err)
+		return false
+	}
+
+	defer zipReader.Close()
+
+	newFileName := sortedFileName(fileName)
+
+	r := csv.NewReader(zipReader)
+
+	// Mapping the columns by the header
+	columns, err := readColumnMap(r, fileName)
+	if err != nil {
+		log.Printf("Could not read header of viewership file: %s, Error: %s\n", fileName, err)
+		return false
+	}
+	quarantine.Track(fileName)
+
+	var entries viewership.ReportEntryList
+	runs := []string{}
+	bufferSize := 0
+	read := 0
+
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if viewership.IsParseError(err) {
+			quarantine.Reject(fileName, viewership.ParseErrorLine(r, err), err, record)
+			continue
+		} else if err != nil {
+			log.Printf("Could not read viewership file: %s, Error: %s\n", fileName, err)
+			return false
+		}
+
+		entry, err := columns.Entry(record)
+		if err != nil {
+			quarantine.Reject(fileName, viewership.RecordLine(r), err, record)
+			continue
+		}
+		entries = append(entries, entry)
+		bufferSize += entrySize(entry)
+		read++
+
+		// 2. the buffer is full - spill it into a sorted run
+		if bufferSize >= maxBufferSize {
+			run, err := spillRun(newFileName, len(runs), entries)
+			if err != nil {
+				log.Printf("Could not save sorted run for: %s, Error: %s\n", fileName, err)
+				return false
+			}
+			runs = append(runs, run)
+			entries = entries[:0]
+			bufferSize = 0
+		}
+	}
+
+	if len(runs) == 0 {
+		// everything fits in memory: sort and save
+		sort.Sort(entries)
+		if !saveCSV(newFileName, entries, false) {
+			os.Remove(newFileName)
+			return false
+		}
+	} else {
+		if len(entries) > 0 {
+			run, err := spillRun(newFileName, len(runs), entries)
+			if err != nil {
+				log.Printf("Could not save sorted run for: %s, Error: %s\n", fileName, err)
+				return false
+			}
+			runs = append(runs, run)
+		}
+		entries = nil
+
+		// 3. merge the runs
+		if err := mergeRuns(runs, newFileName, maxRuns); err != nil {
+			log.Printf("Could not merge sorted runs for: %s, Error: %s\n", fileName, err)
+			os.Remove(newFileName)
+			return false
+		}
+	}
+
+	if verbose {
+		log.Printf("Read: %d entries from %s, sorted in %d runs, rejected %d rows\n", read, fileName, len(runs), quarantine.Count(fileName))
+	}
+
+	return true
+}
+
+// spillRun sorts the entries and saves them into the run file #index next to fileName
+func spillRun(fileName string, index int, entries viewership.ReportEntryList) (string, error) {
+	runFileName := fmt.Sprintf("%s.run%d", fileName, index)
+
+	sort.Sort(entries)
+
+	out, err := os.Create(runFileName)
+	if err != nil {
+		return runFileName, err
+	}
+
+	writer := csv.NewWriter(out)
+	writer.WriteAll(entries.Convert(true, false))
+	if err := writer.Error(); err != nil {
+		out.Close()
+		return runFileName, err
+	}
+	if err := out.Close(); err != nil {
+		return runFileName, err
+	}
+
+	if verbose {
+		log.Printf("Spilled %d entries into %s\n", len(entries), runFileName)
+	}
+	return runFileName, nil
+}
+
+// mergeRuns merge-sorts the sorted runs into fileName, at most maxRuns open at once:
+// while there are more, each pass merges them by maxRuns into the fewer, longer runs
+func mergeRuns(runs []string, fileName string, maxRuns int) error {
+	// merging one run at a time would never end
+	if maxRuns < 2 {
+		maxRuns = 2
+	}
+
+	merged := []string{}
+	defer func() {
+		for _, run := range merged {
+			os.Remove(run)
+		}
+	}()
+
+	for pass := 0; len(runs) > maxRuns; pass++ {
+		passRuns := []string{}
+		for i := 0; i < len(runs); i += maxRuns {
+			end := i + maxRuns
+			if end > len(runs) {
+				end = len(runs)
+			}
+
+			runFileName := fmt.Sprintf("%s.pass%d.run%d", fileName, pass, len(passRuns))
+			merged = append(merged, runFileName)
+			if err := mergeRunsInto(runs[i:end], runFileName); err != nil {
+				return err
+			}
+			passRuns = append(passRuns, runFileName)
+		}
+
+		if verbose {
+			log.Printf("Merged %d runs into %d for %s\n", len(runs), len(passRuns), fileName)
+		}
+		runs = passRuns
+	}
+
+	return mergeRunsInto(runs, fileName)
+}
+
+// mergeRunsInto merge-sorts the sorted runs into fileName in one pass
+func mergeRunsInto(runs []string, fileName string) error {
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(out)
+	// the runs are written with the report columns from the rows already checked, no aliases nor quarantine needed
+	pack := viewership.NewFilesPack(map[string][]string{fileName: runs}, viewership.Options{Verbose: verbose})
+
+	buffer := viewership.ReportEntryList{}
+	header := true
+	for {
+		nextItem, _ := pack.NextMinItem()
+		if nextItem.IsZero() {
+			break
+		}
+
+		buffer = append(buffer, nextItem)
+		if len(buffer) >= viewership.MaxLinesAggregated {
+			writer.WriteAll(buffer.Convert(header, false))
+			buffer = buffer[:0]
+			header = false
+		}
+	}
+	writer.WriteAll(buffer.Convert(header, false))
+
+	// the run failed to read ends the merge early, the file is incomplete
+	if err := pack.Err(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writer.Error(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// writeUnsortedFile writes the gzipped raw file with the rows in random ts order, returns its rows
+func writeUnsortedFile(t *testing.T, fileName string, rows int) []string {
+	t.Helper()
+	random := rand.New(rand.NewSource(1))
+	start := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	lines := []string{}
+	for i := 0; i < rows; i++ {
+		ts := start.Add(time.Duration(random.Intn(24*3600)) * time.Second)
+		lines = append(lines, fmt.Sprintf("%d,%d-1,watch,%s,100,Show,%d,CH,79081,USA",
+			i, i, ts.Format(viewership.TimestampFormat), random.Intn(100)))
+	}
+	writeGzipFile(t, fileName, strings.Join(viewership.Columns, ",")+"\n"+strings.Join(lines, "\n")+"\n")
+	return lines
+}
+
+// writeGzipFile writes the gzipped content into the file, creating its folders
+func writeGzipFile(t *testing.T, fileName, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zipWriter := gzip.NewWriter(file)
+	zipWriter.Write([]byte(content))
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSortedFile reads the rows of the sorted csv file, checking the header and the ts order
+func readSortedFile(t *testing.T, fileName string) []string {
+	t.Helper()
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(viewership.Columns, ",") {
+		t.Fatalf("%s: no header", fileName)
+	}
+
+	lines := []string{}
+	for i, record := range records[1:] {
+		if i > 0 && record[3] < records[i][3] {
+			t.Fatalf("%s: row %d out of order: %s after %s", fileName, i+1, record[3], records[i][3])
+		}
+		lines = append(lines, strings.Join(record, ","))
+	}
+	return lines
+}
+
+// TestSortFileRuns sorts the file in memory, in the runs merged at once, and in more runs than merged at once
+func TestSortFileRuns(t *testing.T) {
+	tests := []struct {
+		name          string
+		rows          int
+		maxBufferSize int
+		maxRuns       int
+	}{
+		{"in memory", 500, 1024 * 1024, maxMergeRuns},
+		{"one pass", 500, 50 * entryOverhead, maxMergeRuns},
+		// one row per run: 200 runs, merged by 64 into 4, then into the file
+		{"passes of max merge runs", 200, 1, maxMergeRuns},
+		// 100 runs merged by 3: 34, 12, 4, 2 runs
+		{"many passes", 500, 5 * entryOverhead, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fileName := filepath.Join(dir, "htc", "tv_viewership_htc_20160601.csv.gz")
+			lines := writeUnsortedFile(t, fileName, test.rows)
+
+			if !sortFile(fileName, test.maxBufferSize, test.maxRuns) {
+				t.Fatal("sortFile failed")
+			}
+
+			sorted := readSortedFile(t, sortedFileName(fileName))
+			sort.Strings(sorted)
+			sort.Strings(lines)
+			if strings.Join(sorted, "\n") != strings.Join(lines, "\n") {
+				t.Errorf("sorted %d rows, not the %d rows of the file", len(sorted), len(lines))
+			}
+
+			// only the original and the sorted file are left, no runs
+			files, _ := filepath.Glob(filepath.Join(dir, "htc", "*"))
+			if len(files) != 2 {
+				t.Errorf("left %v", files)
+			}
+		})
+	}
+}
+
+// TestMergeRunsReadError checks the run failed to read fails the merge instead of cutting the file short
+func TestMergeRunsReadError(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.csv.gz")
+	writeUnsortedFile(t, good, 10)
+	if !sortFile(good, 1024*1024, maxMergeRuns) {
+		t.Fatal("sortFile failed")
+	}
+
+	// the gzipped run cut in the middle of the stream
+	broken := filepath.Join(dir, "broken.csv.gz")
+	content := strings.Join(viewership.Columns, ",") + "\n" +
+		strings.Repeat("1,1-1,watch,2016-06-01 10:00:00,100,Show,4,CH,79081,USA\n", 10000)
+	writeGzipFile(t, broken, content)
+	info, err := os.Stat(broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(broken, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxRuns := range []int{maxMergeRuns, 1} {
+		// 1 is taken as 2, not merging forever
+		if err := mergeRuns([]string{sortedFileName(good), broken}, filepath.Join(dir, "merged.csv"), maxRuns); err == nil {
+			t.Errorf("merged by %d with the broken run", maxRuns)
+		}
+	}
+}
+
+// TestPrepareFile checks the sorted download is kept gzipped for the merge, and the unsorted one is sorted into .csv
+func TestPrepareFile(t *testing.T) {
+	dir := t.TempDir()
+	header := strings.Join(viewership.Columns, ",") + "\n"
+	rows := []string{
+		"1,1-1,watch,2016-06-01 10:00:00,100,Show,4,CH,79081,USA\n",
+		"2,2-1,watch,2016-06-01 10:05:00,100,Show,4,CH,79081,USA\n",
+	}
+
+	sorted := filepath.Join(dir, "htc", "tv_viewership_htc_20160601.csv.gz")
+	writeGzipFile(t, sorted, header+rows[0]+rows[1])
+	unsorted := filepath.Join(dir, "htc", "tv_viewership_htc_20160602.csv.gz")
+	writeGzipFile(t, unsorted, header+rows[1]+rows[0])
+
+	if path, ok := prepareFile(sorted); !ok || path != sorted {
+		t.Errorf("sorted file prepared into %s, %v, expected kept gzipped", path, ok)
+	}
+	if _, err := os.Stat(sorted); err != nil {
+		t.Errorf("sorted file removed: %s", err)
+	}
+
+	path, ok := prepareFile(unsorted)
+	if !ok || path != sortedFileName(unsorted) {
+		t.Fatalf("unsorted file prepared into %s, %v, expected %s", path, ok, sortedFileName(unsorted))
+	}
+	if _, err := os.Stat(unsorted); !os.IsNotExist(err) {
+		t.Errorf("unsorted gzip file kept: %v", err)
+	}
+	if lines := readSortedFile(t, path); len(lines) != 2 {
+		t.Errorf("sorted %d rows, expected 2", len(lines))
+	}
+}
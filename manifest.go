@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// manifestFileName is the download manifest in the working directory
+const manifestFileName = "download_manifest.json"
+
+// ManifestEntry is the downloaded object: its ETag and size at the download,
+// the local file made of it for the merge: the sorted .csv or the .gz kept as is,
+// and if the report days reading this version of the object are regenerated (and published with -P)
+type ManifestEntry struct {
+	ETag        string    `json:"etag"`
+	Size        int64     `json:"size"`
+	Downloaded  time.Time `json:"downloaded"`
+	Path        string    `json:"path"`
+	Regenerated bool      `json:"regenerated"`
+}
+
+// Manifest records the objects downloaded into the working directory by key,
+// so a re-run downloads only the changed or missing objects
+// It is saved after each download, to resume the run that died halfway
+type Manifest struct {
+	fileName string
+	mutex    sync.Mutex
+	entries  map[string]ManifestEntry
+}
+
+// LoadManifest reads the manifest file, the missing or unreadable file is an empty manifest
+func LoadManifest(fileName string) *Manifest {
+	manifest := &Manifest{
+		fileName: fileName,
+		entries:  make(map[string]ManifestEntry),
+	}
+
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return manifest
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &manifest.entries)
+	}
+	if err != nil {
+		log.Printf("Could not read download manifest %s, downloading all the files, Error: %s\n", fileName, err)
+		manifest.entries = make(map[string]ManifestEntry)
+	}
+	return manifest
+}
+
+// IsChanged returns true if the object is new, or its ETag or size differ from the downloaded ones
+func (manifest *Manifest) IsChanged(object ObjectInfo) bool {
+	manifest.mutex.Lock()
+	entry, ok := manifest.entries[object.Key]
+	manifest.mutex.Unlock()
+
+	return !ok || entry.ETag != object.ETag || entry.Size != object.Size
+}
+
+// IsDownloaded returns true if the object is unchanged and its local file is still there,
+// the local files are removed after the runs, so the unchanged object may need downloading again
+func (manifest *Manifest) IsDownloaded(object ObjectInfo) bool {
+	if manifest.IsChanged(object) {
+		return false
+	}
+
+	manifest.mutex.Lock()
+	path := manifest.entries[object.Key].Path
+	manifest.mutex.Unlock()
+
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Path returns the local file of the downloaded object
+func (manifest *Manifest) Path(key string) string {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	return manifest.entries[key].Path
+}
+
+// IsRegenerated returns true if the report days reading the downloaded version of the object are regenerated
+func (manifest *Manifest) IsRegenerated(key string) bool {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	return manifest.entries[key].Regenerated
+}
+
+// Keys returns the keys of the downloaded objects
+func (manifest *Manifest) Keys() []string {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	keys := make([]string, 0, len(manifest.entries))
+	for key := range manifest.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// SetRegenerated records if the report days reading the downloaded objects are regenerated, and saves the manifest
+func (manifest *Manifest) SetRegenerated(keys []string, regenerated bool) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	for _, key := range keys {
+		if entry, ok := manifest.entries[key]; ok {
+			entry.Regenerated = regenerated
+			manifest.entries[key] = entry
+		}
+	}
+	return manifest.save()
+}
+
+// Record records the downloaded object with its local file and saves the manifest
+// The same version downloaded again keeps its regenerated report days, the changed one needs them regenerated
+// The previous local file of the object is removed if it is not the same file,
+// so the merge does not read both the old sorted .csv and the new .gz
+func (manifest *Manifest) Record(object ObjectInfo, path string) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	previous, ok := manifest.entries[object.Key]
+	if ok && previous.Path != path {
+		if err := os.Remove(previous.Path); err != nil && !os.IsNotExist(err) {
+			log.Println("Could not remove the previous download: ", err)
+		}
+	}
+
+	manifest.entries[object.Key] = ManifestEntry{
+		ETag:        object.ETag,
+		Size:        object.Size,
+		Downloaded:  time.Now().UTC(),
+		Path:        path,
+		Regenerated: ok && previous.Regenerated && previous.ETag == object.ETag && previous.Size == object.Size,
+	}
+	return manifest.save()
+}
+
+// SetPath records the new local file of the downloaded object, once it is sorted
+func (manifest *Manifest) SetPath(key, path string) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	entry, ok := manifest.entries[key]
+	if !ok || entry.Path == path {
+		return nil
+	}
+	entry.Path = path
+	manifest.entries[key] = entry
+	return manifest.save()
+}
+
+// save writes the manifest into a temporary file and renames it, so a crash never leaves it half written
+func (manifest *Manifest) save() error {
+	content, err := json.MarshalIndent(manifest.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := manifest.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFileName, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, manifest.fileName)
+}
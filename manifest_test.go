@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDownloadThenRun checks run sorts the files left unsorted by an earlier download instead of skipping them,
+// without downloading them again, and generates the same reports as run alone
+func TestDownloadThenRun(t *testing.T) {
+	dates := []string{"20160531", "20160601", "20160602", "20160603"}
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-01", "-d", "2"}
+
+	alone := newTestPipeline(t, MsoType{"4000002", "htc"})
+	alone.addRawFiles([]string{"htc"}, dates, 100)
+	if err := alone.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	expected := alone.reportFiles("*_20160601.csv")
+
+	staged := newTestPipeline(t, MsoType{"4000002", "htc"})
+	staged.addRawFiles([]string{"htc"}, dates, 100)
+	// already sorted, kept gzipped
+	staged.addRawFile("htc", "20160604", "1,1-1,watch,2016-06-03 10:00:00,100,Show,4,CH4,79081,USA")
+
+	if err := staged.run("download", "-from", "2016-06-01", "-to", "2016-06-02", "-d", "2"); err != nil {
+		t.Fatal(err)
+	}
+	downloaded := LoadManifest(manifestFileName)
+	for _, date := range append(dates, "20160604") {
+		if path := downloaded.Path(rawKey("htc", date)); path != rawKey("htc", date) {
+			t.Errorf("downloaded %s into %s, expected the .gz as is", date, path)
+		}
+	}
+
+	if err := staged.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	manifest := LoadManifest(manifestFileName)
+	for _, date := range dates {
+		key := rawKey("htc", date)
+		if path := manifest.Path(key); path != strings.TrimSuffix(key, ".gz") {
+			t.Errorf("%s prepared into %s, expected the sorted .csv", date, path)
+		}
+		if !manifest.entries[key].Downloaded.Equal(downloaded.entries[key].Downloaded) {
+			t.Errorf("%s downloaded again", date)
+		}
+	}
+	if key := rawKey("htc", "20160604"); manifest.Path(key) != key {
+		t.Errorf("sorted %s into %s, expected kept gzipped", key, manifest.Path(key))
+	}
+
+	reports := staged.reportFiles("*_20160601.csv")
+	for fileName, content := range expected {
+		if reports[fileName] != content {
+			t.Errorf("%s after download differs from run alone", fileName)
+		}
+	}
+}
+
+// TestDownloadThenRunMissing checks the file removed since the download is downloaded again by run
+func TestDownloadThenRunMissing(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"})
+	pipeline.addRawFiles([]string{"htc"}, []string{"20160601", "20160602"}, 50)
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-01", "-d", "1"}
+
+	if err := pipeline.run("download", args...); err != nil {
+		t.Fatal(err)
+	}
+	key := rawKey("htc", "20160601")
+	downloaded := LoadManifest(manifestFileName)
+	if err := os.Remove(filepath.Join(pipeline.work, filepath.FromSlash(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pipeline.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	manifest := LoadManifest(manifestFileName)
+	if path := manifest.Path(key); path != strings.TrimSuffix(key, ".gz") {
+		t.Errorf("prepared into %s, expected the sorted .csv", path)
+	}
+	if manifest.entries[key].Downloaded.Equal(downloaded.entries[key].Downloaded) {
+		t.Error("the removed file not downloaded again")
+	}
+}
+
+// TestManifestIsChanged checks the object recorded is changed once rewritten with the other ETag or size,
+// and downloaded only while its local file is on disk
+func TestManifestIsChanged(t *testing.T) {
+	store := newTestStore(t, map[string]string{"raw/a.csv.gz": "content"})
+	fileName := filepath.Join(store.root, "raw", "a.csv.gz")
+	manifest := LoadManifest(filepath.Join(t.TempDir(), manifestFileName))
+	path := filepath.Join(t.TempDir(), "a.csv.gz")
+	writeTestFile(t, path, "content")
+
+	object := func() ObjectInfo {
+		objects, err := store.List("raw/")
+		if err != nil || len(objects) != 1 {
+			t.Fatalf("List: %v, %s", objects, err)
+		}
+		return objects[0]
+	}
+
+	if !manifest.IsChanged(object()) {
+		t.Error("the new object not changed")
+	}
+	if err := manifest.Record(object(), path); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.IsChanged(object()) || !manifest.IsDownloaded(object()) {
+		t.Error("the recorded object changed or not downloaded")
+	}
+
+	// the same size, rewritten later: the other ETag
+	writeTestFile(t, fileName, "CONTENT")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fileName, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.IsChanged(object()) {
+		t.Error("the rewritten object not changed")
+	}
+
+	// the other size only
+	rewritten := object()
+	if err := manifest.Record(rewritten, path); err != nil {
+		t.Fatal(err)
+	}
+	rewritten.Size++
+	if !manifest.IsChanged(rewritten) {
+		t.Error("the resized object not changed")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.IsChanged(object()) || manifest.IsDownloaded(object()) {
+		t.Error("the object removed from disk changed or still downloaded")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ObjectInfo describes a single object in the store
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// ObjectStore abstracts the place the raw files are read from and the reports are written to,
+// so that the pipeline can run against S3 as well as a local directory tree
+type ObjectStore interface {
+	// List returns all the objects with keys starting with prefix
+	List(prefix string) ([]ObjectInfo, error)
+	// ListFolders returns the names of the folders right under the prefix folder
+	ListFolders(prefix string) ([]string, error)
+	// Get downloads the object into w, returns the number of bytes written
+	Get(key string, w io.WriterAt) (int64, error)
+	// Put uploads the content of r under the key
+	Put(key string, r io.Reader) error
+}
+
+// ----------------------------------------------------------------------
+
+// S3Store is an ObjectStore backed by an AWS S3 bucket
+type S3Store struct {
+	bucket     string
+	svc        *s3.S3
+	downloader *s3manager.Downloader
+	uploader   *s3manager.Uploader
+}
+
+// NewS3Store creates a store for the bucket in the region
+func NewS3Store(region, bucket string) *S3Store {
+	sess := session.New(&aws.Config{
+		Region: aws.String(region),
+	})
+
+	return &S3Store{
+		bucket:     bucket,
+		svc:        s3.New(sess),
+		downloader: s3manager.NewDownloader(sess),
+		uploader:   s3manager.NewUploader(sess),
+	}
+}
+
+// List returns the objects in the bucket under the prefix,
+// following the continuation tokens until the whole listing is read
+func (store *S3Store) List(prefix string) ([]ObjectInfo, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	objects := []ObjectInfo{}
+	pages := 0
+	truncated := false
+
+	err := store.svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		pages++
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				ETag:         strings.Trim(aws.StringValue(object.ETag), "\""),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		truncated = aws.BoolValue(page.IsTruncated)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the last page must not be truncated, otherwise we would be silently missing objects
+	if truncated {
+		return nil, errors.New("Listing truncated for prefix: " + prefix)
+	}
+
+	if verbose {
+		log.Printf("Listed %d objects in %d pages for prefix: %s\n", len(objects), pages, prefix)
+	}
+	return objects, nil
+}
+
+// ListFolders returns the common prefixes under the prefix, delimited by "/"
+func (store *S3Store) ListFolders(prefix string) ([]string, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(store.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+
+	folders := []string{}
+	truncated := false
+
+	err := store.svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			folder := strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), prefix)
+			folders = append(folders, strings.TrimSuffix(folder, "/"))
+		}
+		truncated = aws.BoolValue(page.IsTruncated)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if truncated {
+		return nil, errors.New("Listing truncated for prefix: " + prefix)
+	}
+	return folders, nil
+}
+
+// Get downloads the object from the bucket
+func (store *S3Store) Get(key string, w io.WriterAt) (int64, error) {
+	return store.downloader.Download(w,
+		&s3.GetObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(key),
+		})
+}
+
+// Put uploads the object into the bucket
+func (store *S3Store) Put(key string, r io.Reader) error {
+	_, err := store.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	return err
+}
+
+// ----------------------------------------------------------------------
+
+// LocalStore is an ObjectStore backed by a directory tree, keys are paths relative to the root
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore creates a store rooted at the directory
+func NewLocalStore(root string) *LocalStore {
+	return &LocalStore{root: root}
+}
+
+func (store *LocalStore) path(key string) string {
+	return filepath.Join(store.root, filepath.FromSlash(key))
+}
+
+// List walks the directory tree and returns the files with keys starting with prefix
+func (store *LocalStore) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+
+	// walk only the folder the prefix points into
+	dir := store.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = store.path(prefix[:i])
+	}
+
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(store.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{
+				Key:          key,
+				Size:         f.Size(),
+				ETag:         localETag(f),
+				LastModified: f.ModTime(),
+			})
+		}
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return objects, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// localETag is the weak ETag of the file: its modification time and size, changing whenever the file is rewritten
+func localETag(f os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", f.ModTime().UnixNano(), f.Size())
+}
+
+// ListFolders returns the sub-directories of the prefix directory
+func (store *LocalStore) ListFolders(prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(store.path(prefix))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	folders := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			folders = append(folders, info.Name())
+		}
+	}
+	return folders, nil
+}
+
+// Get copies the file into w
+func (store *LocalStore) Get(key string, w io.WriterAt) (int64, error) {
+	file, err := os.Open(store.path(key))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(&offsetWriter{w: w}, file)
+}
+
+// Put writes the content of r into the file, creating the folders if needed
+func (store *LocalStore) Put(key string, r io.Reader) error {
+	path := store.path(key)
+	if err := createPath(path); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// offsetWriter adapts io.WriterAt to a sequential io.Writer
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (writer *offsetWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.WriteAt(p, writer.offset)
+	writer.offset += int64(n)
+	return n, err
+}
+
+// newObjectStore returns the local store if the directory is provided, S3 otherwise
+func newObjectStore(localDir, region, bucket string) ObjectStore {
+	if localDir != "" {
+		if verbose {
+			log.Println("Using local object store:", localDir)
+		}
+		return NewLocalStore(localDir)
+	}
+	return NewS3Store(region, bucket)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes the content into the file, creating its folders
+func writeTestFile(t *testing.T, fileName, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestStore creates the local store with the files: key -> content
+func newTestStore(t *testing.T, files map[string]string) *LocalStore {
+	t.Helper()
+	root := t.TempDir()
+	for key, content := range files {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(key)), content)
+	}
+	return NewLocalStore(root)
+}
+
+func objectKeys(objects []ObjectInfo) []string {
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+// TestLocalStoreList checks the listing of the keys starting with the prefix, sorted, with their sizes
+func TestLocalStoreList(t *testing.T) {
+	store := newTestStore(t, map[string]string{
+		"raw/20160601/htc/tv_viewership_htc_20160601.csv.gz":     "htc",
+		"raw/20160601/hc/tv_viewership_hc_20160601.csv.gz":       "hc-1",
+		"raw/20160602/htc/tv_viewership_htc_20160602.csv.gz":     "htc-2",
+		"reports/20160601/aggregated_viewership_20160601.csv.gz": "report",
+	})
+
+	tests := []struct {
+		prefix string
+		keys   []string
+	}{
+		{"raw/20160601/", []string{
+			"raw/20160601/hc/tv_viewership_hc_20160601.csv.gz",
+			"raw/20160601/htc/tv_viewership_htc_20160601.csv.gz",
+		}},
+		{"raw/20160601/htc/tv_viewership_htc", []string{
+			"raw/20160601/htc/tv_viewership_htc_20160601.csv.gz",
+		}},
+		{"raw/2016060", []string{
+			"raw/20160601/hc/tv_viewership_hc_20160601.csv.gz",
+			"raw/20160601/htc/tv_viewership_htc_20160601.csv.gz",
+			"raw/20160602/htc/tv_viewership_htc_20160602.csv.gz",
+		}},
+		{"raw/20160603/", []string{}},
+		{"missing/", []string{}},
+	}
+
+	for _, test := range tests {
+		objects, err := store.List(test.prefix)
+		if err != nil {
+			t.Errorf("List(%q): %s", test.prefix, err)
+			continue
+		}
+		if keys := objectKeys(objects); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("List(%q) = %v, expected %v", test.prefix, keys, test.keys)
+		}
+	}
+
+	objects, _ := store.List("raw/20160602/")
+	if len(objects) != 1 || objects[0].Size != int64(len("htc-2")) {
+		t.Errorf("List(raw/20160602/) = %+v, expected one object of %d bytes", objects, len("htc-2"))
+	}
+}
+
+// TestLocalStoreListFolders checks only the folders right under the prefix are listed
+func TestLocalStoreListFolders(t *testing.T) {
+	store := newTestStore(t, map[string]string{
+		"raw/20160601/htc/a.csv.gz": "a",
+		"raw/20160601/hc/b.csv.gz":  "b",
+		"raw/20160602/htc/c.csv.gz": "c",
+		"raw/readme.txt":            "not a folder",
+	})
+
+	tests := []struct {
+		prefix  string
+		folders []string
+	}{
+		{"raw", []string{"20160601", "20160602"}},
+		{"raw/", []string{"20160601", "20160602"}},
+		{"raw/20160601", []string{"hc", "htc"}},
+		{"missing", []string{}},
+	}
+
+	for _, test := range tests {
+		folders, err := store.ListFolders(test.prefix)
+		if err != nil {
+			t.Errorf("ListFolders(%q): %s", test.prefix, err)
+			continue
+		}
+		if !reflect.DeepEqual(folders, test.folders) {
+			t.Errorf("ListFolders(%q) = %v, expected %v", test.prefix, folders, test.folders)
+		}
+	}
+}
+
+// TestLocalStorePutGet checks Put creates the folders and Get reads the same content back
+func TestLocalStorePutGet(t *testing.T) {
+	store := NewLocalStore(t.TempDir())
+	content := strings.Repeat("112961,112961-1,watch\n", 1000)
+
+	if err := store.Put("reports/20160601/report.csv", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "report.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	n, err := store.Get("reports/20160601/report.csv", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("Get wrote %d bytes, expected %d", n, len(content))
+	}
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("Get read back %d bytes different from the put ones", len(got))
+	}
+
+	if _, err := store.Get("reports/20160602/report.csv", out); !os.IsNotExist(err) {
+		t.Errorf("Get of the missing key: %v, expected not exist", err)
+	}
+}
+
+// TestLocalStoreETag checks the ETag stays for the same file and changes with its rewrite
+func TestLocalStoreETag(t *testing.T) {
+	store := newTestStore(t, map[string]string{"raw/a.csv.gz": "content"})
+	fileName := filepath.Join(store.root, "raw", "a.csv.gz")
+
+	etag := func() string {
+		objects, err := store.List("raw/")
+		if err != nil || len(objects) != 1 {
+			t.Fatalf("List: %v, %s", objects, err)
+		}
+		return objects[0].ETag
+	}
+
+	first := etag()
+	if again := etag(); again != first {
+		t.Errorf("ETag of the same file changed: %s, %s", first, again)
+	}
+
+	// the same size, rewritten later
+	writeTestFile(t, fileName, "CONTENT")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fileName, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := etag()
+	if rewritten == first {
+		t.Errorf("ETag did not change with the rewrite: %s", rewritten)
+	}
+
+	// the other size, the same time
+	writeTestFile(t, fileName, "longer content")
+	if err := os.Chtimes(fileName, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if resized := etag(); resized == rewritten {
+		t.Errorf("ETag did not change with the size: %s", resized)
+	}
+}
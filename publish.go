@@ -0,0 +1,145 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// formatPublishFolder returns the reports folder for the window:
+// viewership2d, hh_count3d, ... (the report day plus daysAfter days)
+func formatPublishFolder(report string, daysAfter int) string {
+	return fmt.Sprintf("%s%dd", report, daysAfter+1)
+}
+
+// formatPublishKey returns the key of the published report:
+// viewership2d/20160601/aggregated_viewership_20160601.csv.gz
+func formatPublishKey(folder, date, fileName string) string {
+	return fmt.Sprintf("%s/%s/%s", folder, date, fileName)
+}
+
+// PublishReports uploads the aggregated reports for the report days into the destination store:
+// aggregated_viewership_<date>.csv/.jsonl gzipped (.parquet as is) into <viewerFolder><N>d/<date>/,
+// hh_count_<mso>_<date>.csv, device_count_<mso>_<date>.csv and devices_per_hh_<mso>_<date>.csv
+// into <hhCountFolder><N>d/<date>/, with hh_set_<mso>_<date>.csv gzipped for the reach,
+// program_reach_<date>.csv into <reachFolder><N>d/<date>/,
+// sessions_<date>.csv gzipped into <sessionsFolder><N>d/<date>/ if the sessions are built,
+// quarter_hour_ratings_<date>.csv into <ratingsFolder><N>d/<date>/ if the ratings are built
+// The local files are removed once published
+func PublishReports(store ObjectStore, reportDays []string, daysAfter int) error {
+	viewershipReports := formatPublishFolder(viewerFolder, daysAfter)
+	hhCountReports := formatPublishFolder(hhCountFolder, daysAfter)
+	sessionsReports := formatPublishFolder(sessionsFolder, daysAfter)
+	reachReports := formatPublishFolder(reachFolder, daysAfter)
+	ratingsReports := formatPublishFolder(ratingsFolder, daysAfter)
+
+	failed := 0
+	for _, reportDay := range reportDays {
+		fileName := formatAggregatedFilename(reportDay)
+		key := formatPublishKey(viewershipReports, reportDay, fileName)
+		compress := outputFormat != viewership.FormatParquet
+		if compress {
+			key += ".gz"
+		}
+		if err := publishFile(store, fileName, key, compress); err != nil {
+			log.Printf("Failed publishing %s to %s, Error: %s\n", fileName, key, err)
+			failed++
+		}
+
+		reachFileName := formatReportFilename("program_reach", reportDay)
+		reachKey := formatPublishKey(reachReports, reportDay, reachFileName)
+		if err := publishFile(store, reachFileName, reachKey, false); err != nil {
+			log.Printf("Failed publishing %s to %s, Error: %s\n", reachFileName, reachKey, err)
+			failed++
+		}
+
+		if sessions {
+			fileName := formatReportFilename("sessions", reportDay)
+			key := formatPublishKey(sessionsReports, reportDay, fileName+".gz")
+			if err := publishFile(store, fileName, key, true); err != nil {
+				log.Printf("Failed publishing %s to %s, Error: %s\n", fileName, key, err)
+				failed++
+			}
+		}
+
+		if ratings {
+			fileName := formatReportFilename("quarter_hour_ratings", reportDay)
+			key := formatPublishKey(ratingsReports, reportDay, fileName)
+			if err := publishFile(store, fileName, key, false); err != nil {
+				log.Printf("Failed publishing %s to %s, Error: %s\n", fileName, key, err)
+				failed++
+			}
+		}
+
+		for _, mso := range msoList {
+			for _, report := range []string{"hh_count_", "device_count_", "devices_per_hh_"} {
+				fileName := formatReportFilename(report+mso.Name, reportDay)
+				key := formatPublishKey(hhCountReports, reportDay, fileName)
+				if err := publishFile(store, fileName, key, false); err != nil {
+					log.Printf("Failed publishing %s to %s, Error: %s\n", fileName, key, err)
+					failed++
+				}
+			}
+
+			fileName := formatHHSetFilename(mso.Name, reportDay)
+			key := formatPublishKey(hhCountReports, reportDay, fileName+".gz")
+			if err := publishFile(store, fileName, key, true); err != nil {
+				log.Printf("Failed publishing %s to %s, Error: %s\n", fileName, key, err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed publishing %d files", failed)
+	}
+	return nil
+}
+
+// publishFile uploads the file under the key, gzipping it on the fly if requested,
+// and removes the local file
+func publishFile(store ObjectStore, fileName, key string, compress bool) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var body io.Reader = file
+	var reader *io.PipeReader
+	if compress {
+		var writer *io.PipeWriter
+		reader, writer = io.Pipe()
+		go func() {
+			zipWriter := gzip.NewWriter(writer)
+			_, err := io.Copy(zipWriter, file)
+			if err == nil {
+				err = zipWriter.Close()
+			}
+			writer.CloseWithError(err)
+		}()
+		body = reader
+	}
+
+	if err = store.Put(key, body); err != nil {
+		// the upload stopped reading, unblock the gzip goroutine
+		if reader != nil {
+			reader.CloseWithError(err)
+		}
+		return err
+	}
+
+	if verbose {
+		log.Printf("Published %s to %s\n", fileName, key)
+	}
+
+	if err = os.Remove(fileName); err != nil {
+		return errors.New("Could not remove published file: " + err.Error())
+	}
+	return nil
+}
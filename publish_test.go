@@ -0,0 +1,122 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readPublished reads the published report, gunzipping the .gz one
+func readPublished(t *testing.T, fileName string) string {
+	t.Helper()
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(fileName, ".gz") {
+		zipReader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("%s: %s", fileName, err)
+		}
+		defer zipReader.Close()
+		r = zipReader
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %s", fileName, err)
+	}
+	return string(content)
+}
+
+// TestPublishReports publishes the reports of the run into the local store: each report into its folder
+// for the window, gzipped if expected, and removed from the working directory
+func TestPublishReports(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"})
+	pipeline.addRawFiles([]string{"htc", "hc"}, []string{"20160531", "20160601", "20160602", "20160603"}, 100)
+
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-01", "-d", "2", "-s"}
+	if err := pipeline.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	reports := pipeline.reportFiles("*_20160601.csv")
+
+	if err := pipeline.run("publish", args...); err != nil {
+		t.Fatal(err)
+	}
+
+	published := map[string]string{
+		"aggregated_viewership_20160601.csv": "viewership3d/20160601/aggregated_viewership_20160601.csv.gz",
+		"program_reach_20160601.csv":         "program_reach3d/20160601/program_reach_20160601.csv",
+		"sessions_20160601.csv":              "sessions3d/20160601/sessions_20160601.csv.gz",
+	}
+	for _, mso := range []string{"htc", "hc"} {
+		for _, report := range []string{"hh_count_", "device_count_", "devices_per_hh_"} {
+			fileName := report + mso + "_20160601.csv"
+			published[fileName] = "hh_count3d/20160601/" + fileName
+		}
+		published["hh_set_"+mso+"_20160601.csv"] = "hh_count3d/20160601/hh_set_" + mso + "_20160601.csv.gz"
+	}
+
+	for fileName, key := range published {
+		content, ok := reports[fileName]
+		if !ok {
+			t.Errorf("%s not generated", fileName)
+			continue
+		}
+		if got := readPublished(t, filepath.Join(pipeline.reports, filepath.FromSlash(key))); got != content {
+			t.Errorf("%s published into %s differs", fileName, key)
+		}
+		if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+			t.Errorf("%s not removed once published: %v", fileName, err)
+		}
+	}
+}
+
+// failingStore fails the uploads after reading their first part
+type failingStore struct {
+	ObjectStore
+}
+
+func (store failingStore) Put(key string, r io.Reader) error {
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		return err
+	}
+	return errors.New("upload failed")
+}
+
+// TestPublishFileFailed checks the failed upload keeps the file and does not leave the gzip goroutine blocked
+func TestPublishFileFailed(t *testing.T) {
+	// not compressible, so the gzip goroutine keeps writing
+	content := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	fileName := filepath.Join(t.TempDir(), "hh_set_htc_20160601.csv")
+	writeTestFile(t, fileName, string(content))
+
+	goroutines := runtime.NumGoroutine()
+	if err := publishFile(failingStore{}, fileName, "hh_count3d/20160601/hh_set_htc_20160601.csv.gz", true); err == nil {
+		t.Fatal("published into the failing store")
+	}
+
+	if _, err := os.Stat(fileName); err != nil {
+		t.Errorf("file not published removed: %s", err)
+	}
+
+	for wait := 0; runtime.NumGoroutine() > goroutines; wait++ {
+		if wait == 100 {
+			t.Fatalf("%d goroutines left, %d before the publish", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// quarantineReportFile is the per-file count of the rejected rows, written at the end of each run
+const quarantineReportFile = "rejected_rows.csv"
+
+// Quarantine keeps the rows rejected while reading the input files:
+// <quarantineDir>/<input file>.rejected.csv with the line, the reason and the original row
+type Quarantine struct {
+	dir   string
+	mutex sync.Mutex
+	files map[string]*quarantineFile
+}
+
+type quarantineFile struct {
+	out    *os.File
+	writer *csv.Writer
+	lines  map[int]bool
+}
+
+var quarantine = NewQuarantine("quarantine")
+
+// NewQuarantine creates the quarantine keeping the files under dir
+func NewQuarantine(dir string) *Quarantine {
+	return &Quarantine{
+		dir:   dir,
+		files: make(map[string]*quarantineFile),
+	}
+}
+
+// SetDir changes the folder of the quarantine files
+func (quarantine *Quarantine) SetDir(dir string) {
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+	quarantine.dir = dir
+}
+
+// Track registers the input file read, so its count is reported even if none of its rows are rejected
+func (quarantine *Quarantine) Track(fileName string) {
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+	quarantine.file(fileName)
+}
+
+// file returns the quarantine of the input file, registering it if not yet
+func (quarantine *Quarantine) file(fileName string) *quarantineFile {
+	file, ok := quarantine.files[fileName]
+	if !ok {
+		file = &quarantineFile{lines: make(map[int]bool)}
+		quarantine.files[fileName] = file
+	}
+	return file
+}
+
+// quarantineFileName returns the quarantine file of the input file
+func (quarantine *Quarantine) quarantineFileName(fileName string) string {
+	return filepath.Join(quarantine.dir, fileName+".rejected.csv")
+}
+
+// Reject writes the row at the line of the input file into its quarantine file
+// The same line is quarantined only once, even if the file is read several times
+func (quarantine *Quarantine) Reject(fileName string, line int, reason error, record []string) {
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+
+	file := quarantine.file(fileName)
+	if file.lines[line] {
+		return
+	}
+
+	// the quarantine file is created with the first rejected row
+	if len(file.lines) == 0 {
+		quarantineFileName := quarantine.quarantineFileName(fileName)
+		if err := createPath(quarantineFileName); err != nil {
+			log.Println("Could not create quarantine folder: ", err)
+		} else if file.out, err = os.Create(quarantineFileName); err != nil {
+			log.Println("Could not create quarantine file: ", err)
+		} else {
+			file.writer = csv.NewWriter(file.out)
+			file.writer.Write([]string{"line", "reason", "row"})
+		}
+	}
+	file.lines[line] = true
+
+	if verbose {
+		log.Printf("Rejected row in %s, line %d: %s\n", fileName, line, reason)
+	}
+
+	if file.writer != nil {
+		file.writer.Write(append([]string{strconv.Itoa(line), reason.Error()}, record...))
+	}
+}
+
+// Count returns the number of the rejected rows of the input file
+func (quarantine *Quarantine) Count(fileName string) int {
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+
+	if file, ok := quarantine.files[fileName]; ok {
+		return len(file.lines)
+	}
+	return 0
+}
+
+// Close flushes and closes the quarantine files, and merges the per-file rejected rows count into reportFileName:
+// the counts of the files read by this run replace their previous counts, 0 and the quarantine file removed
+// if none of the rows are rejected now, the counts of the other files written by the earlier stages are kept,
+// so a staged sort then aggregate keeps the counts of the sort
+// The report is not touched if no files were read
+// Returns the total number of the rejected rows
+func (quarantine *Quarantine) Close(reportFileName string) int {
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+
+	if len(quarantine.files) == 0 {
+		return 0
+	}
+
+	fileNames := make([]string, 0, len(quarantine.files))
+	for fileName := range quarantine.files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	counts := readRejectedCounts(reportFileName)
+	total := 0
+	for _, fileName := range fileNames {
+		file := quarantine.files[fileName]
+		if file.writer != nil {
+			file.writer.Flush()
+			file.out.Close()
+		}
+
+		if len(file.lines) > 0 {
+			log.Printf("Rejected %d rows in %s\n", len(file.lines), fileName)
+		} else {
+			// rejected by the earlier runs
+			os.Remove(quarantine.quarantineFileName(fileName))
+		}
+		counts[fileName] = len(file.lines)
+		total += len(file.lines)
+	}
+	quarantine.files = make(map[string]*quarantineFile)
+
+	reported := make([]string, 0, len(counts))
+	for fileName := range counts {
+		reported = append(reported, fileName)
+	}
+	sort.Strings(reported)
+
+	content := [][]string{{"file", "rejected_rows"}}
+	for _, fileName := range reported {
+		content = append(content, []string{fileName, strconv.Itoa(counts[fileName])})
+	}
+
+	viewership.WriteCSV(reportFileName, content, true)
+	return total
+}
+
+// readRejectedCounts reads the per-file rejected rows count written by the earlier runs, if any
+func readRejectedCounts(reportFileName string) map[string]int {
+	counts := make(map[string]int)
+
+	file, err := os.Open(reportFileName)
+	if err != nil {
+		return counts
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		log.Printf("Could not read %s, Error: %s\n", reportFileName, err)
+		return counts
+	}
+
+	for i, record := range records {
+		if i == 0 || len(record) != 2 {
+			continue
+		}
+		if count, err := strconv.Atoi(record[1]); err == nil {
+			counts[record[0]] = count
+		}
+	}
+	return counts
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readRejectedReport reads the per-file rejected rows count, failing the test if there is no report
+func readRejectedReport(t *testing.T, reportFileName string) map[string]int {
+	t.Helper()
+	if _, err := os.Stat(reportFileName); err != nil {
+		t.Fatal(err)
+	}
+	return readRejectedCounts(reportFileName)
+}
+
+// TestQuarantineClose checks the counts of every file read replace their previous counts, 0 included,
+// and the counts of the files not read are kept
+func TestQuarantineClose(t *testing.T) {
+	dir := t.TempDir()
+	reportFileName := filepath.Join(dir, quarantineReportFile)
+	record := []string{"1", "1-1", "watch", "not a ts"}
+	reason := errors.New("invalid ts")
+
+	quarantine := NewQuarantine(dir)
+	quarantine.Track("a.csv")
+	quarantine.Track("b.csv")
+	quarantine.Reject("b.csv", 2, reason, record)
+	quarantine.Reject("b.csv", 5, reason, record)
+	// read again
+	quarantine.Reject("b.csv", 5, reason, record)
+	quarantine.Reject("c.csv", 3, reason, record)
+
+	if total := quarantine.Close(reportFileName); total != 3 {
+		t.Errorf("rejected %d rows, expected 3", total)
+	}
+	expected := map[string]int{"a.csv": 0, "b.csv": 2, "c.csv": 1}
+	if counts := readRejectedReport(t, reportFileName); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("first run counts %v, expected %v", counts, expected)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.csv.rejected.csv")); err != nil {
+		t.Errorf("no quarantine file: %s", err)
+	}
+
+	// b.csv is fixed, c.csv is not read
+	quarantine.Track("b.csv")
+	if total := quarantine.Close(reportFileName); total != 0 {
+		t.Errorf("rejected %d rows, expected 0", total)
+	}
+	expected = map[string]int{"a.csv": 0, "b.csv": 0, "c.csv": 1}
+	if counts := readRejectedReport(t, reportFileName); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("second run counts %v, expected %v", counts, expected)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.csv.rejected.csv")); !os.IsNotExist(err) {
+		t.Errorf("quarantine file of the fixed file kept: %v", err)
+	}
+
+	// nothing read
+	if err := os.Remove(reportFileName); err != nil {
+		t.Fatal(err)
+	}
+	quarantine.Close(reportFileName)
+	if _, err := os.Stat(reportFileName); !os.IsNotExist(err) {
+		t.Errorf("report written with no files read: %v", err)
+	}
+}
+
+// TestQuarantineRerun checks the rejected rows count of the raw file fixed since the earlier run goes back to 0
+func TestQuarantineRerun(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"})
+	good := "1,1-1,watch,2016-06-01 10:00:00,100,Show,4,CH4,79081,USA"
+	bad := "1,1-1,watch,not a ts,100,Show,4,CH4,79081,USA"
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-01", "-d", "1"}
+
+	pipeline.addRawFile("htc", "20160601", good, bad)
+	if err := pipeline.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	key := rawKey("htc", "20160601")
+	if counts := readRejectedReport(t, quarantineReportFile); counts[key] != 1 {
+		t.Fatalf("first run counts %v, expected 1 for %s", counts, key)
+	}
+
+	// the fixed file is downloaded again
+	pipeline.addRawFile("htc", "20160601", good, good)
+	if err := pipeline.run("run", args...); err != nil {
+		t.Fatal(err)
+	}
+	if counts := readRejectedReport(t, quarantineReportFile); counts[key] != 0 {
+		t.Errorf("rerun counts %v, expected 0 for %s", counts, key)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// reachWindows are the rolling windows in days for the reach report
+var reachWindows = []int{1, 7, 28}
+
+// formatHHSetFilename returns the name of the MSO's household set for the day: hh_set_<mso>_<date>.csv
+func formatHHSetFilename(mso, date string) string {
+	return formatReportFilename("hh_set_"+mso, date)
+}
+
+// reportHHSets writes the distinct households of the report day per MSO for the reach:
+// hh_set_<mso>_<date>.csv
+func reportHHSets(aggregated *viewership.AggregatedReport) {
+	for mso, set := range aggregated.HouseholdSets() {
+		fileName := formatHHSetFilename(mso, formatDate(aggregated.ReportDate()))
+
+		out, err := os.Create(fileName)
+		if err != nil {
+			log.Println("Error creating household set: ", err)
+			continue
+		}
+
+		if err := viewership.WriteHouseholdSet(out, set); err != nil {
+			log.Printf("Error writing household set: %s, Error: %s\n", fileName, err)
+		}
+		out.Close()
+	}
+}
+
+// loadHHSet reads the MSO's household set for the day: from the working directory if just counted,
+// otherwise from the published hh_count reports
+func loadHHSet(mso, date string) (viewership.HouseholdSet, error) {
+	fileName := formatHHSetFilename(mso, date)
+	if file, err := os.Open(fileName); err == nil {
+		defer file.Close()
+		return viewership.ReadHouseholdSet(file)
+	}
+
+	key := formatPublishKey(formatPublishFolder(hhCountFolder, daysAfter), date, fileName+".gz")
+	file, err := os.Create(fileName + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fileName + ".gz")
+	defer file.Close()
+
+	if _, err := publishStore.Get(key, file); err != nil {
+		return nil, fmt.Errorf("Could not download %s, Error: %s", key, err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	zipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	return viewership.ReadHouseholdSet(zipReader)
+}
+
+// getReachDays returns the days from the start of the longest window before dateFrom to dateTo
+func getReachDays(dateFrom, dateTo string) []string {
+	dtFrom, _ := time.Parse("20060102", dateFrom)
+	dtTo, _ := time.Parse("20060102", dateTo)
+
+	longest := reachWindows[len(reachWindows)-1]
+	days := []string{}
+	for dt := dtFrom.AddDate(0, 0, 1-longest); !dt.After(dtTo); dt = dt.AddDate(0, 0, 1) {
+		days = append(days, dt.Format("20060102"))
+	}
+	return days
+}
+
+// runReach counts the unique households per MSO from the household sets of the days:
+// over the rolling windows for each day dateFrom-dateTo into reach_<from>_<to>.csv,
+// and over the whole dateFrom-dateTo range into reach_range_<from>_<to>.csv
+// The reports are written even with the household sets missing, but the command fails, as they are undercounted
+func runReach(dateRange []string) error {
+	days := getReachDays(dateFrom, dateTo)
+	// the days before the range are only for the rolling windows
+	first := reachWindows[len(reachWindows)-1] - 1
+
+	header := []string{"date", "provider_code"}
+	for _, window := range reachWindows {
+		header = append(header, fmt.Sprintf("hh_id_count_%dd", window))
+	}
+	reach := [][]string{header}
+	reachRange := [][]string{{"from", "to", "provider_code", "hh_id_count"}}
+
+	missing := 0
+	for _, mso := range msoList {
+		sets := make(map[string]viewership.HouseholdSet)
+		rangeSet := make(viewership.HouseholdSet)
+
+		for i, day := range days {
+			set, err := loadHHSet(mso.Name, day)
+			// the days before the range are in the rolling windows of the first days of the range,
+			// missing them undercounts these windows the same
+			if err != nil {
+				log.Printf("Missing household set for %s on %s: %s\n", mso.Name, day, err)
+				missing++
+				continue
+			}
+
+			sets[day] = set
+			if i >= first {
+				rangeSet.Add(set)
+			}
+		}
+
+		windows := [][]int{}
+		for _, window := range reachWindows {
+			windows = append(windows, viewership.RollingReach(days, sets, window))
+		}
+
+		for i := first; i < len(days); i++ {
+			day, _ := time.Parse("20060102", days[i])
+			row := []string{day.Format("2006-01-02"), mso.Code}
+			for _, counts := range windows {
+				row = append(row, strconv.Itoa(counts[i]))
+			}
+			reach = append(reach, row)
+		}
+		reachRange = append(reachRange, []string{dateFrom, dateTo, mso.Code, strconv.Itoa(len(rangeSet))})
+	}
+
+	viewership.WriteCSV(fmt.Sprintf("reach_%s_%s.csv", dateFrom, dateTo), reach, true)
+	viewership.WriteCSV(fmt.Sprintf("reach_range_%s_%s.csv", dateFrom, dateTo), reachRange, true)
+
+	if missing > 0 {
+		return fmt.Errorf("Missing %d household sets, the reach is undercounted", missing)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gevgev/viewership-aggregator/viewership"
+)
+
+// publishHHSet publishes the MSO's household set for the date gzipped, as hhcount -P does with -d 2
+func (pipeline *testPipeline) publishHHSet(mso, date string, hhs ...string) {
+	pipeline.t.Helper()
+	set := make(viewership.HouseholdSet)
+	for _, hh := range hhs {
+		set[hh] = true
+	}
+
+	var buffer bytes.Buffer
+	zipWriter := gzip.NewWriter(&buffer)
+	if err := viewership.WriteHouseholdSet(zipWriter, set); err != nil {
+		pipeline.t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		pipeline.t.Fatal(err)
+	}
+
+	key := formatPublishKey(formatPublishFolder("hh_count", 2), date, formatHHSetFilename(mso, date)+".gz")
+	writeTestFile(pipeline.t, filepath.Join(pipeline.reports, filepath.FromSlash(key)), buffer.String())
+}
+
+// TestReachReport checks the rolling 1, 7 and 28-day reach over the published household sets,
+// the 28 days before the range included, and the reach over the range
+func TestReachReport(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"})
+
+	// every day 1, the first day of the 28-day window of 2016-06-01 also 2, 2016-06-02 also 3
+	start := time.Date(2016, 5, 5, 0, 0, 0, 0, time.UTC)
+	for day := start; !day.After(time.Date(2016, 6, 3, 0, 0, 0, 0, time.UTC)); day = day.AddDate(0, 0, 1) {
+		hhs := []string{"1"}
+		switch day.Format("20060102") {
+		case "20160505":
+			hhs = append(hhs, "2")
+		case "20160602":
+			hhs = append(hhs, "3")
+		}
+		pipeline.publishHHSet("htc", day.Format("20060102"), hhs...)
+	}
+
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-03", "-d", "2"}
+	if err := pipeline.run("reach", args...); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"reach_20160601_20160603.csv": "date,provider_code,hh_id_count_1d,hh_id_count_7d,hh_id_count_28d\n" +
+			"2016-06-01,4000002,1,1,2\n" +
+			"2016-06-02,4000002,2,2,2\n" +
+			"2016-06-03,4000002,1,2,2\n",
+		"reach_range_20160601_20160603.csv": "from,to,provider_code,hh_id_count\n" +
+			"20160601,20160603,4000002,2\n",
+	}
+	reports := pipeline.reportFiles("reach_*.csv")
+	for fileName, content := range expected {
+		if reports[fileName] != content {
+			t.Errorf("%s:\n%s\nexpected:\n%s", fileName, reports[fileName], content)
+		}
+	}
+
+	// the set of a day before the range is missing: the 28-day windows are undercounted
+	if err := os.Remove(filepath.Join(pipeline.reports, "hh_count3d", "20160510", "hh_set_htc_20160510.csv.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.run("reach", args...); err == nil {
+		t.Error("reach with the household set before the range missing did not fail")
+	}
+}
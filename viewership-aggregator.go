@@ -1,10 +1,9 @@
 package main
 
 import (
-	"compress/gzip"
 	"encoding/csv"
-	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -14,10 +13,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gevgev/viewership-aggregator/viewership"
 )
 
 func formatDefaultDate() string {
@@ -40,100 +36,77 @@ var (
 	regionName      string
 	bucketName      string
 	prefix          string
+	localDir        string
+	publishRegion   string
+	publishBucket   string
+	publishDir      string
+	configFile      string
+	quarantineDir   string
+	viewerFolder    string
+	hhCountFolder   string
+	sessionsFolder  string
+	reachFolder     string
+	ratingsFolder   string
 	dateFrom        string
 	dateTo          string
 	msoListFilename string
 	maxAttempts     int
 	concurrency     int
+	sortMemory      int
+	dayConcurrency  int
+	dayMemory       int
 	daysAfter       int
 
 	verbose bool
 	testRun bool
-	appName string
+	publish bool
+	// dedup drops the duplicate events re-sent in the overlapping daily files
+	dedup bool
+	// sessions writes sessions_<date>.csv next to aggregated_viewership
+	sessions           bool
+	sessionIdleTimeout time.Duration
+	sessionMaxLength   time.Duration
+	// outputFormat is the format of aggregated_viewership: csv, parquet, jsonl
+	outputFormat string
+	rowGroupMB   int
+	compression  string
+	// sqliteDB is the SQLite database the events and the counts are also written into, if set
+	sqliteDB string
+	// ratings writes quarter_hour_ratings_<date>.csv, counting the households tuned in for ratingsMinutes
+	ratings        bool
+	ratingsMinutes int
+	// forceDownload downloads all the files again, ignoring the download manifest
+	forceDownload bool
+	// autoRange finds dateFrom/dateTo from the stores
+	autoRange bool
+	appName   string
+
+	sourceStore  ObjectStore
+	publishStore ObjectStore
 
 	failedFilesChan         chan string
-	downloadedReportChannel chan bool
+	downloadedReportChannel chan string
 
 	// MSOLookup is map of MSO IDs to MSO names
 	MSOLookup map[string]string
 	msoList   []MsoType
+	// configMsos is the MSO list from the config file, replacing the MSO list file
+	configMsos []MsoType
 )
 
-func init() {
-
-	flagRegion := flag.String("r", "us-west-2", "`AWS Region`")
-	flagBucket := flag.String("b", "daaprawcdwdata", "`Bucket name`")
-	flagPrefix := flag.String("p", "cdw_viewership_reports", "`Prefix` for the objecst in the bucket")
-	flagDateFrom := flag.String("from", formatDefaultDate(), "`Date from`")
-	flagDateTo := flag.String("to", formatDefaultDate(), "`Date to`")
-	flagMsoFileName := flag.String("m", "mso-list.csv", "Filename for `MSO` list")
-	flagMaxAttempts := flag.Int("M", MAXATTEMPTS, "`Max attempts` to retry download from aws.s3")
-	flagConcurrency := flag.Int("c", 10, "The number of files to process `concurrent`ly")
-	flagDaysAfter := flag.Int("d", 2, "The number of days to go back for the report")
-	flagHelp := flag.Bool("h", false, "Help")
-	flagTestRun := flag.Bool("t", false, "Test run to dump full csv as well")
-
-	flagVerbose := flag.Bool("v", true, "`Verbose`: outputs to the screen")
-
-	flag.Parse()
-	if flag.Parsed() {
-		appName = os.Args[0]
-
-		if *flagHelp {
-			usage()
-		}
-
-		regionName = *flagRegion
-		bucketName = *flagBucket
-		prefix = *flagPrefix
-		dateFrom = formatDate(*flagDateFrom)
-		dateTo = formatDate(*flagDateTo)
-		msoListFilename = *flagMsoFileName
-		maxAttempts = *flagMaxAttempts
-		concurrency = *flagConcurrency
-		daysAfter = *flagDaysAfter
-
-		verbose = *flagVerbose
-		testRun = *flagTestRun
-
-		if verbose {
-			log.Printf("Provided From: %s, converted to %s\n", *flagDateFrom, dateFrom)
-			log.Printf("Provided To: %s, converted to %s\n", *flagDateTo, dateTo)
-		}
-	} else {
-		usage()
-	}
-
-}
-
-func usage() {
-	fmt.Printf("%s, ver. %s\n", appName, version)
-	fmt.Println("Command line:")
-	fmt.Printf("\tprompt$>%s -r <aws_region> -b <s3_bucket_name> -p <prefix> -from <date> -to <date> -d <days to aggregate> -m <mso-list-file-name> -M <max_retry>\n", appName)
-	flag.Usage()
-	os.Exit(-1)
-}
-
-// PrintParams prints out the parameters provided to the app
-func PrintParams() {
-	log.Printf("Provided: -r: %s, -b: %s, -p %S -from: %v, -to: %v, -d %d -m %s, -M %d, -v: %v\n",
-		regionName,
-		bucketName,
-		prefix,
-		dateFrom,
-		dateTo,
-		daysAfter,
-		msoListFilename,
-		maxAttempts,
-		verbose,
-	)
-
-}
-
 // MsoType aggregates MSO code and name
 type MsoType struct {
-	Code string
-	Name string
+	Code string `yaml:"code"`
+	Name string `yaml:"name"`
+}
+
+// msoNames returns the names of the MSO's in the list
+func msoNames() []string {
+	names := []string{}
+	for _, mso := range msoList {
+		names = append(names, mso.Name)
+	}
+	return names
 }
 
 func getMsoCode(mso string) string {
@@ -150,6 +123,14 @@ func getMsoNamesList() ([]MsoType, map[string]string) {
 	msoList := []MsoType{}
 	msoLookup := make(map[string]string)
 
+	if len(configMsos) > 0 {
+		for _, mso := range configMsos {
+			msoList = append(msoList, mso)
+			msoLookup[mso.Code] = mso.Name
+		}
+		return msoList, msoLookup
+	}
+
 	msoFile, err := os.Open(msoListFilename)
 	if err != nil {
 		log.Fatalf("Could not open Mso List file: %s, Error: %s\n", msoListFilename, err)
@@ -170,117 +151,136 @@ func getMsoNamesList() ([]MsoType, map[string]string) {
 	return msoList, msoLookup
 }
 
-// formatPrefix formats path per mso
-func formatPrefix(path, msoCode string) string {
-	return fmt.Sprintf("%s/%s/delta/", path, msoCode)
+// formatPrefix formats path per date and mso:
+// cdw_viewership_reports/20160601/armstrong_butler/
+func formatPrefix(path, date, msoName string) string {
+	return fmt.Sprintf("%s/%s/%s/", path, date, msoName)
 }
 
-// convertToDateParts converts/breaks the "20160601" string into yy, mm, dd
-func convertToDateParts(dtStr string) (yy, mm, dd int) {
-	// 0123 45 67
-	// 2016 06 01
-	//
-	yy, mm, dd = 0, 0, 0
-	i, err := strconv.Atoi(dtStr[:4])
+// getDateRange generates
+// a list of strings for each date in range to lookup
+// starting one day before (from - 1) -to- N daysAfter (to + daysAfter)
+func getDateRange(dateFrom, dateTo string, daysAfter int) []string {
+	dateRange, err := viewership.DateRange(dateFrom, dateTo, daysAfter)
 	if err != nil {
-		return yy, mm, dd
+		log.Println(err)
+		log.Println("Nothing to do")
+		os.Exit(-1)
 	}
-	yy = i
 
-	i, err = strconv.Atoi(dtStr[4:6])
-	if err != nil {
-		return yy, mm, dd
+	if verbose {
+		log.Println("Working From:", dateRange[0])
+		log.Println("Working To:", dateRange[len(dateRange)-1])
 	}
-	mm = i
+	return dateRange
+}
 
-	i, err = strconv.Atoi(dtStr[6:])
-	if err != nil {
-		return yy, mm, dd
+func printRangeString(dateRangeRegexStr []string) {
+	log.Println("Dates range:")
+	for _, str := range dateRangeRegexStr {
+		log.Println(str)
 	}
-	dd = i
-	return yy, mm, dd
 }
 
-// getDateRange generates
-// a list of strings for each date in range to lookup
-// starting one day before (from - 1) -to- N daysAfter (to + daysAfter)
-func getDateRange(dateFrom, dateTo string, daysAfter int) []string {
-
-	regExpStr := []string{}
-	//'20160630'
-	yy, mm, dd := convertToDateParts(dateFrom)
-	dtFrom := time.Date(yy, time.Month(mm), dd, 0, 0, 0, 0, time.UTC)
-	if verbose {
-		log.Printf("Provided From: string:%s, parsed into: %d, %d, %d, converted into %v\n",
-			dateFrom, yy, mm, dd, dtFrom.String())
+// DownloadFiles downloads the files for the dates range from the source store into the working directory,
+// sorting them after the download if sortFiles is set
+// The objects unchanged since their download and still on disk, as recorded in the download manifest,
+// are skipped unless forceDownload, with sortFiles the ones downloaded without sorting are sorted now
+// Returns the lists of the keys downloaded and failed to download
+func DownloadFiles(dateRange []string, sortFiles bool) (downloadedList, failedFilesList []string) {
+	manifest := LoadManifest(manifestFileName)
+
+	objects := []ObjectInfo{}
+	skipped := 0
+	for _, object := range listSourceFiles(dateRange) {
+		if !forceDownload && manifest.IsDownloaded(object) && (!sortFiles || prepareDownloaded(manifest, object.Key)) {
+			if verbose {
+				log.Println("Unchanged since the last download, skipping: ", object.Key)
+			}
+			skipped++
+			continue
+		}
+		objects = append(objects, object)
 	}
 
-	yy, mm, dd = convertToDateParts(dateTo)
-	dtTo := time.Date(yy, time.Month(mm), dd, 0, 0, 0, 0, time.UTC)
+	if skipped > 0 {
+		log.Printf("Skipped %d files unchanged since the last download\n", skipped)
+	}
+	return downloadObjects(objects, manifest, sortFiles)
+}
 
-	if verbose {
-		log.Printf("Provided To: string:%s, parsed into: %d, %d, %d, converted into %v\n",
-			dateTo, yy, mm, dd, dtTo.String())
+// prepareDownloaded makes the local file of the downloaded object ready for the merge, if it is not yet:
+// the download stage keeps the .gz as is, unsorted
+// Returns false if the file could not be sorted, to download it again
+func prepareDownloaded(manifest *Manifest, key string) bool {
+	path := manifest.Path(key)
+	if !viewership.IsGzipFile(path) {
+		return true
 	}
 
-	if dtFrom.After(dtTo) { // || dtFrom.Equal(dtTo) {
-		log.Printf("Date from %v is greater or equal than date to: %v\n", dtFrom, dtTo)
-		log.Println("Nothing to do")
-		os.Exit(-1)
+	path, ok := prepareFile(path)
+	if !ok {
+		return false
 	}
+	if err := manifest.SetPath(key, path); err != nil {
+		log.Println("Could not save download manifest: ", err)
+	}
+	return true
+}
 
-	dtFrom = dtFrom.AddDate(0, 0, -1)
-	dtTo = dtTo.AddDate(0, 0, daysAfter)
+// listSourceFiles lists the raw files of the MSOs for the dates range in the source store
+func listSourceFiles(dateRange []string) []ObjectInfo {
+	files := []ObjectInfo{}
+	listed := 0
+	for _, eachDate := range dateRange {
 
-	if verbose {
-		log.Println("Working From:", dtFrom.String())
-		log.Println("Working To:", dtTo.String())
-	}
+		for _, mso := range msoList {
+			// List only the objects for this date/mso
+			objects, err := sourceStore.List(formatPrefix(prefix, eachDate, mso.Name))
+			if err != nil {
+				log.Println("Failed to list objects: ", err)
+				os.Exit(-1)
+			}
+			listed += len(objects)
 
-	dt := dtFrom
-	for {
-		regExpStr = append(regExpStr, dt.Format("20060102"))
-		if verbose {
-			log.Printf("Appending for %s = %s\n", dt.String(), dt.Format("20060102"))
-		}
+			//cdw_viewership_reports/20160601/armstrong_butler/tv_viewreship_armstrong_butler_20160601.csv
+			lookupKey := fmt.Sprintf("%s_%s.csv", mso.Name, eachDate)
 
-		dt = dt.AddDate(0, 0, 1)
-		if dt.After(dtTo) {
-			break
-		}
-	}
+			if verbose {
+				log.Println("Lookup key: ", lookupKey)
+			}
 
-	return regExpStr
-}
+			for _, key := range objects {
+				if verbose {
+					log.Println("Key: ", key.Key)
+				}
 
-func printRangeString(dateRangeRegexStr []string) {
-	log.Println("Dates range:")
-	for _, str := range dateRangeRegexStr {
-		log.Println(str)
+				if strings.Contains(key.Key, lookupKey) {
+					files = append(files, key)
+				}
+			}
+		}
 	}
+
+	log.Println("Number of objects: ", listed)
+	return files
 }
 
-func main() {
-	startTime := time.Now()
+// downloadObjects downloads the objects into the working directory, up to concurrency at a time,
+// sorting them after the download if sortFiles is set, and records them in the manifest
+// Returns the lists of the keys downloaded and failed to download
+func downloadObjects(objects []ObjectInfo, manifest *Manifest, sortFiles bool) (downloadedList, failedFilesList []string) {
 	countingDone := make(chan bool)
 
 	// This is our semaphore/pool
 	sem := make(chan bool, concurrency)
 
-	downloaded := 0
-
 	failedFilesChan = make(chan string)
-	downloadedReportChannel = make(chan bool)
-
-	msoList, MSOLookup = getMsoNamesList()
-
-	if verbose {
-		PrintParams()
-	}
-
-	dateRange := getDateRange(dateFrom, dateTo, daysAfter)
+	downloadedReportChannel = make(chan string)
 
-	failedFilesList := []string{}
+	downloadedList = []string{}
+	failedFilesList = []string{}
+	failedDone := make(chan bool)
 	var wg sync.WaitGroup
 
 	// Listening to failed reports
@@ -290,6 +290,7 @@ func main() {
 			if more {
 				failedFilesList = append(failedFilesList, key)
 			} else {
+				failedDone <- true
 				return
 			}
 		}
@@ -298,9 +299,9 @@ func main() {
 	// listening to succeeded reports
 	go func() {
 		for {
-			_, more := <-downloadedReportChannel
+			key, more := <-downloadedReportChannel
 			if more {
-				downloaded++
+				downloadedList = append(downloadedList, key)
 			} else {
 				countingDone <- true
 				return
@@ -308,153 +309,381 @@ func main() {
 		}
 	}()
 
-	session := session.New(&aws.Config{
-		Region: aws.String(regionName),
-	})
+	for _, object := range objects {
+		// download the file (add to a queue of downloads)
+		// if we still have available goroutine in the pool (out of concurrency )
+		sem <- true
+		wg.Add(1)
+		go func(object ObjectInfo) {
+			defer func() { <-sem }()
+			processSingleDownload(object, manifest, &wg, sortFiles)
+		}(object)
+	}
 
-	svc := s3.New(session)
+	// Reports
+	if verbose {
+		log.Println("All files sent to be downloaded. Waiting for completetion...")
+	}
 
-	params := &s3.ListObjectsInput{
-		Bucket: aws.String(bucketName), // daap-viewership-reports
-		Prefix: aws.String(prefix),
+	for i := 0; i < cap(sem); i++ {
+		sem <- true
 	}
 
-	// Get the list of all objects
-	resp, err := svc.ListObjects(params)
-	if err != nil {
-		log.Println("Failed to list objects: ", err)
-		os.Exit(-1)
+	wg.Wait()
+	if verbose {
+		log.Println("All download jobs completed, closing failed/succeeded jobs channel")
 	}
 
-	log.Println("Number of objects: ", len(resp.Contents))
-	for _, key := range resp.Contents {
-		// iterate through the list to match the dates range/mso name
-		// using the constracted below lookup string
+	close(failedFilesChan)
+	close(downloadedReportChannel)
+	<-countingDone
+	close(countingDone)
+	<-failedDone
+
+	log.Printf("Downloaded %d files\n", len(downloadedList))
+	ReportFailedFiles(failedFilesList)
 
-		if verbose {
-			log.Println("Key: ", *key.Key)
-		}
+	return downloadedList, failedFilesList
+}
 
-		for _, mso := range msoList {
+// sourceKeyDate returns the date folder of the source key:
+// cdw_viewership_reports/20160601/armstrong_butler/tv_viewership_armstrong_butler_20160601.csv.gz -> 20160601
+func sourceKeyDate(key string) string {
+	return strings.SplitN(strings.TrimPrefix(key, prefix+"/"), "/", 2)[0]
+}
 
-			for _, eachDate := range dateRange {
-				//cdw_viewership_reports/20160601/armstrong_butler/tv_viewreship_armstrong_butler_20160601.csv
-				lookupKey := fmt.Sprintf("%s_%s.csv", mso.Name, eachDate)
+// GenerateDailyAggregatesMergeSort generates the aggregated reports using merge-sort from files:
+// aggregated_viewership files if writeEvents is set, hh_count files if writeCounts is set
+// The report days are independent, so they are processed concurrently by dayWorkers() workers
+// Returns the report days failed to generate
+func GenerateDailyAggregatesMergeSort(dateFrom string, dateRange []string, daysForward int, writeEvents, writeCounts bool) []string {
+	return generateReportDays(dateRange, viewership.ReportDayIndexes(dateFrom, dateRange, daysForward), daysForward, writeEvents, writeCounts)
+}
 
-				if verbose {
-					log.Println("Lookup key: ", lookupKey)
+// generateReportDays generates the aggregated reports for the report days dateRange[reportIndexes]
+// Returns the report days failed to generate, sorted
+func generateReportDays(dateRange []string, reportIndexes []int, daysForward int, writeEvents, writeCounts bool) []string {
+	log.Println("Starting reading/aggregating the results")
+
+	days := make(chan int)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := []string{}
+
+	workers := dayWorkers()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for reportIndex := range days {
+				if err := generateDailyAggregate(dateRange, reportIndex, daysForward, writeEvents, writeCounts); err != nil {
+					log.Printf("Failed generating the reports for %s, Error: %s\n", dateRange[reportIndex], err)
+					mutex.Lock()
+					failed = append(failed, dateRange[reportIndex])
+					mutex.Unlock()
 				}
+			}
+		}()
+	}
+
+	for _, i := range reportIndexes {
+		days <- i
+	}
+	close(days)
 
-				if strings.Contains(*key.Key, lookupKey) {
-					// download the file (add to a queue of downloads)
-					// load the csv file, add the count to appropriate counter
-					// if we still have available goroutine in the pool (out of concurrency )
-					sem <- true
-					wg.Add(1)
-					go func(key string) {
-						defer func() { <-sem }()
-						processSingleDownload(key, &wg)
-					}(*key.Key)
+	wg.Wait()
+	sort.Strings(failed)
+	return failed
+}
+
+// generateDailyAggregate generates the aggregated report for the day dateRange[reportIndex]
+// Returns the first error, the reports of the day are not complete then
+func generateDailyAggregate(dateRange []string, reportIndex int, daysForward int, writeEvents, writeCounts bool) error {
+	reportDay := dateRange[reportIndex]
+
+	fileList := make(map[string][]string)
+	for _, mso := range msoList {
+		fileList[mso.Name] = []string{}
+	}
+	var err error
+
+	if verbose {
+		log.Printf("Adding %d files per MSO for reporting date: %v\n", daysForward+1, reportDay)
+	}
+	// Adding files with the requested days before for THIS reporting day
+	// Starting one day before -1 -up-to- N daysForward
+	for _, date := range viewership.ReportDayDates(dateRange, reportIndex, daysForward) {
+		if verbose {
+			log.Printf("ReportDay: %s, ReportIndex: %d, DayForward: %d, date: %s\n", reportDay, reportIndex, daysForward, date)
+		}
+		err = filepath.Walk(filepath.Join(prefix, date), func(path string, f os.FileInfo, err error) error {
+			if isFileToPush(path) {
+				// s3://daaprawcdwdata/cdw_viewership_reports/20160814/armstrong_butler/tv_viewership_armstrong_butler_20160814.csv
+				// 2016/07/31 18:23:39 Key:  cdw_viewership_reports/20160814/armstrong_butler/tv_viewership_armstrong_butler_20160814.csv.gz
+				// 2016/07/31 18:23:39 Lookup key:  htc_20160727.csv
+				// 2016/07/31 18:23:39 Lookup key:  htc_20160728.csv
+				msoName := getMsoFromPath(path)
+				fileList[msoName] = append(fileList[msoName], path)
+				if verbose {
+					log.Printf("Added %s for reporting date: %v\n", path, reportDay)
 				}
 			}
+			return nil
+		})
+	}
 
+	// dayErr is the first error generating the reports, the day is reported failed
+	var dayErr error
+	fail := func(err error) {
+		if dayErr == nil {
+			dayErr = err
 		}
 	}
 
-	// Now aggregate the counts and generate the aggregated report
-	// save the report csv?
+	if err != nil {
+		log.Println("Error walking the provided path: ", err)
+		fail(err)
+	}
 
-	// Reports
-	if verbose {
-		log.Println("All files sent to be downloaded. Waiting for completetion...")
+	// Now start processing the files to generate the aggregated reports
+	sink, err := newAggregatedSink(reportDay, writeEvents)
+	if err != nil {
+		log.Println("Error while creating aggregator: ", err)
+		return err
+	}
+
+	filesPack := viewership.NewFilesPack(fileList, readOptions())
+	aggregatedReport := viewership.NewAggregatedReportSink(sink, msoNames())
+	aggregatedReport.SetDedup(dedup)
+	aggregatedReport.SetProgramReach(writeCounts)
+
+	if sqliteDB != "" && writeEvents {
+		dbSink, err := viewership.NewSQLiteSink(sqliteDB, reportDay, viewership.SinkOptions{ProviderCodes: msoProviderCodes()})
+		if err != nil {
+			log.Println("Error while opening the SQLite database: ", err)
+			fail(err)
+		} else {
+			aggregatedReport.AddSink(dbSink)
+		}
 	}
 
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
+	var sessionsReport *viewership.SessionsReport
+	if sessions && writeEvents {
+		if sessionsReport, err = viewership.NewSessionsReport(formatReportFilename("sessions", reportDay)); err != nil {
+			log.Println("Error while creating sessions report: ", err)
+			fail(err)
+		} else {
+			aggregatedReport.SetSessions(viewership.NewSessionBuilder(sessionIdleTimeout, sessionMaxLength, sessionsReport.WriteSession))
+		}
 	}
 
-	wg.Wait()
-	if verbose {
-		log.Println("All download jobs completed, closing failed/succeeded jobs channel")
+	var channelRatings *viewership.QuarterHourRatings
+	if ratings && writeEvents {
+		if channelRatings, err = viewership.NewQuarterHourRatings(reportDay, time.Duration(ratingsMinutes)*time.Minute); err != nil {
+			log.Println("Error while creating ratings: ", err)
+			fail(err)
+		} else {
+			aggregatedReport.SetRatings(channelRatings, sessionIdleTimeout)
+		}
 	}
 
-	close(failedFilesChan)
-	close(downloadedReportChannel)
-	<-countingDone
-	close(countingDone)
+	aggregatedReport.ProcessFiles(filesPack, reportDay)
+	if err := aggregatedReport.Err(); err != nil {
+		fail(err)
+	}
+	if sessionsReport != nil {
+		if err := sessionsReport.Close(); err != nil {
+			log.Println(err)
+			fail(err)
+		}
+	}
+	if channelRatings != nil {
+		reportRatings(channelRatings, aggregatedReport.ReportDate())
+	}
+	if writeCounts {
+		reportHHCounts(aggregatedReport)
+		reportDeviceCounts(aggregatedReport)
+		reportHHSets(aggregatedReport)
+		reportProgramReach(aggregatedReport)
+	}
+	if dedup {
+		reportDuplicates(aggregatedReport)
+	}
+	return dayErr
+}
 
-	ReportFailedFiles(failedFilesList)
+// formatAggregatedFilename returns the name of the aggregated report in the output format:
+// aggregated_viewership_<date>.csv, aggregated_viewership_<date>.parquet, aggregated_viewership_<date>.jsonl
+func formatAggregatedFilename(date string) string {
+	return fmt.Sprintf("aggregated_viewership_%s%s", date, viewership.FormatExtension(outputFormat))
+}
 
-	GenerateDailyAggregatesMergeSort(dateFrom, dateRange, daysAfter)
+// newAggregatedSink creates the sink of the output format for the aggregated report,
+// no sink if the events are not written
+func newAggregatedSink(reportDay string, writeEvents bool) (viewership.EventSink, error) {
+	if !writeEvents {
+		return nil, nil
+	}
 
-	log.Printf("Processed %d MSO's, %d days, in %v\n", len(msoList), len(dateRange), time.Since(startTime))
+	return viewership.NewEventSink(outputFormat, formatAggregatedFilename(reportDay), viewership.SinkOptions{
+		RowGroupSize:  int64(rowGroupMB) * 1024 * 1024,
+		Compression:   compression,
+		ProviderCodes: msoProviderCodes(),
+	})
 }
 
-// GenerateDailyAggregatesMergeSort generates the aggregated reports using merge-sort from files
-func GenerateDailyAggregatesMergeSort(dateFrom string, dateRange []string, daysForward int) {
-	log.Println("Starting reading/aggregating the results")
+// msoProviderCodes maps the MSO names to their provider codes
+func msoProviderCodes() map[string]string {
+	providerCodes := make(map[string]string)
+	for _, mso := range msoList {
+		providerCodes[mso.Name] = mso.Code
+	}
+	return providerCodes
+}
 
-	reportDay := dateFrom
-	reportIndex := 0
+// reportHHCounts writes the unique households count of the report day per MSO:
+// hh_count_<mso>_<date>.csv
+func reportHHCounts(aggregated *viewership.AggregatedReport) {
+	for mso, count := range aggregated.HHCounts() {
+		fileName := fmt.Sprintf("hh_count_%s_%s.csv", mso, formatDate(aggregated.ReportDate()))
+
+		var content [][]string
+		content = append(content, []string{"date", "provider_code", "hh_id_count"})
+		content = append(content, []string{aggregated.ReportDate(), getMsoCode(mso), strconv.Itoa(count)})
+		viewership.WriteCSV(fileName, content, true)
+	}
+}
 
-	for i, eachDay := range dateRange {
+// reportDeviceCounts writes the devices and events counts of the report day per MSO, next to hh_count:
+// device_count_<mso>_<date>.csv, and the devices per household distribution: devices_per_hh_<mso>_<date>.csv
+func reportDeviceCounts(aggregated *viewership.AggregatedReport) {
+	date := aggregated.ReportDate()
+	for mso, counts := range aggregated.Counts() {
+		var content [][]string
+		content = append(content, []string{"date", "provider_code", "hh_id_count", "device_id_count", "event_count"})
+		content = append(content, []string{
+			date,
+			getMsoCode(mso),
+			strconv.Itoa(counts.Households),
+			strconv.Itoa(counts.Devices),
+			strconv.Itoa(counts.Events),
+		})
+		viewership.WriteCSV(formatReportFilename("device_count_"+mso, formatDate(date)), content, true)
 
-		fileList := make(map[string][]string)
-		for _, mso := range msoList {
-			fileList[mso.Name] = []string{}
+		devices := make([]int, 0, len(counts.DevicesPerHousehold))
+		for n := range counts.DevicesPerHousehold {
+			devices = append(devices, n)
+		}
+		sort.Ints(devices)
+
+		content = [][]string{{"date", "provider_code", "devices", "hh_id_count"}}
+		for _, n := range devices {
+			content = append(content, []string{date, getMsoCode(mso), strconv.Itoa(n), strconv.Itoa(counts.DevicesPerHousehold[n])})
 		}
-		var err error
+		viewership.WriteCSV(formatReportFilename("devices_per_hh_"+mso, formatDate(date)), content, true)
+	}
+}
 
-		if eachDay == reportDay {
+// reportProgramReach writes the distinct households and devices per MSO per program for the report day:
+// program_reach_<date>.csv
+func reportProgramReach(aggregated *viewership.AggregatedReport) {
+	var content [][]string
+	content = append(content, []string{"date", "provider_code", "pg_id", "pg_name", "hh_id_count", "device_id_count"})
+	for _, reach := range aggregated.ProgramReach() {
+		content = append(content, []string{
+			aggregated.ReportDate(),
+			getMsoCode(reach.Mso),
+			reach.ProgramID,
+			reach.ProgramName,
+			strconv.Itoa(reach.Households),
+			strconv.Itoa(reach.Devices),
+		})
+	}
+	viewership.WriteCSV(formatReportFilename("program_reach", formatDate(aggregated.ReportDate())), content, true)
+}
 
-			reportIndex = i
+// reportRatings writes the households tuned in per quarter-hour slot, MSO and channel for the report day:
+// quarter_hour_ratings_<date>.csv
+func reportRatings(channelRatings *viewership.QuarterHourRatings, reportDate string) {
+	var content [][]string
+	content = append(content, []string{"date", "slot", "provider_code", "ch_name", "hh_id_count"})
+	for _, rating := range channelRatings.Ratings() {
+		content = append(content, []string{
+			reportDate,
+			rating.Slot.Format("15:04"),
+			getMsoCode(rating.Mso),
+			rating.ChannelName,
+			strconv.Itoa(rating.Households),
+		})
+	}
+	viewership.WriteCSV(formatReportFilename("quarter_hour_ratings", formatDate(reportDate)), content, true)
+}
 
-			if verbose {
-				log.Printf("Adding %d files per MSO for reporting date: %v\n", daysForward+1, reportDay)
-			}
-			// Adding files with the requested days before for THIS reporting day
-			// Starting one day before -1 -up-to- N daysForward
-			for jj := reportIndex - 1; jj <= reportIndex+daysForward; jj++ {
-				if verbose {
-					log.Printf("ReportDay: %s, ReportIndex: %d, DayForward: %d, jj: %d\n", reportDay, reportIndex, daysForward, jj)
-					log.Println(dateRange)
+// reportDuplicates logs and writes the number of the duplicate events dropped per MSO for the report day:
+// duplicates_<date>.csv
+func reportDuplicates(aggregated *viewership.AggregatedReport) {
+	duplicates := aggregated.Duplicates()
+
+	msos := make([]string, 0, len(duplicates))
+	for mso := range duplicates {
+		msos = append(msos, mso)
+	}
+	sort.Strings(msos)
+
+	var content [][]string
+	content = append(content, []string{"date", "provider_code", "mso", "duplicates"})
+	for _, mso := range msos {
+		if duplicates[mso] > 0 {
+			log.Printf("Dropped %d duplicate events for %s on %s\n", duplicates[mso], mso, aggregated.ReportDate())
+		}
+		content = append(content, []string{aggregated.ReportDate(), getMsoCode(mso), mso, strconv.Itoa(duplicates[mso])})
+	}
+	viewership.WriteCSV(formatReportFilename("duplicates", formatDate(aggregated.ReportDate())), content, true)
+}
+
+// dayWorkers returns the number of report days to process concurrently:
+// the requested number of workers, limited by the available memory
+func dayWorkers() int {
+	workers := dayConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	if dayMemory > 0 {
+		if available := availableMemoryMB(); available > 0 {
+			if byMemory := available / dayMemory; byMemory < workers {
+				workers = byMemory
+				if workers < 1 {
+					workers = 1
 				}
-				err = filepath.Walk("cdw_viewership_reports/"+dateRange[jj]+"/", func(path string, f os.FileInfo, err error) error {
-					if isFileToPush(path) {
-						// s3://daaprawcdwdata/cdw_viewership_reports/20160814/armstrong_butler/tv_viewership_armstrong_butler_20160814.csv
-						// 2016/07/31 18:23:39 Key:  cdw_viewership_reports/20160814/armstrong_butler/tv_viewership_armstrong_butler_20160814.csv.gz
-						// 2016/07/31 18:23:39 Lookup key:  htc_20160727.csv
-						// 2016/07/31 18:23:39 Lookup key:  htc_20160728.csv
-						msoName := strings.Split(path, "/")[2]
-						fileList[msoName] = append(fileList[msoName], path)
-						if verbose {
-							log.Printf("Added %s for reporting date: %v\n", path, reportDay)
-						}
-					}
-					return nil
-				})
 			}
-
-			if err != nil {
-				log.Println("Error walking the provided path: ", err)
+			if verbose {
+				log.Printf("Available memory: %d MB, %d MB per day, using %d day workers\n", available, dayMemory, workers)
 			}
+		}
+	}
+	return workers
+}
 
-			// Now start processing the files to generate the aggregated reports
-			filesPack := NewFilesPack(fileList)
-			aggregatedReport, err := NewAggregatedReport(formatReportFilename("aggregated_viewership", reportDay))
-			if err == nil {
-				aggregatedReport.ProcessFiles(filesPack, reportDay)
-				aggregatedReport.ReportHHCounts()
-			} else {
-				log.Printf("Error while creating aggregator: ", err)
-			}
+// availableMemoryMB returns MemAvailable from /proc/meminfo in MB, or 0 if unknown
+func availableMemoryMB() int {
+	content, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
 
-			// Next report day
-			if reportIndex+1+daysAfter < len(dateRange) {
-				reportDay = dateRange[reportIndex+1]
+	for _, line := range strings.Split(string(content), "\n") {
+		// MemAvailable:   12345678 kB
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0
 			}
+			return kb / 1024
 		}
 	}
+	return 0
 }
 
 func formatReportFilename(fileName, date string) string {
@@ -462,7 +691,7 @@ func formatReportFilename(fileName, date string) string {
 }
 
 // PrintFinalReport prints the summary of app run
-func PrintFinalReport(report ReportEntryList, date string, wg *sync.WaitGroup) {
+func PrintFinalReport(report viewership.ReportEntryList, date string, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	log.Println("Aggregated final for:", date)
@@ -475,119 +704,41 @@ func PrintFinalReport(report ReportEntryList, date string, wg *sync.WaitGroup) {
 
 	if testRun {
 		log.Println("Saving full dump:")
-		saveCSV(date+"_full_dump.csv", report)
+		saveCSV(date+"_full_dump.csv", report, true)
 	}
 
-	saveCSV(reportFileName, reportForDate)
+	saveCSV(reportFileName, reportForDate, true)
 	log.Println("Saved the report in file: ", reportFileName)
 }
 
-func saveCSV(reportFileName string, reportForDate ReportEntryList) {
+// saveCSV saves the entries into the csv file with the header, returns false if the file could not be written
+func saveCSV(reportFileName string, reportForDate viewership.ReportEntryList, addQuotes bool) bool {
 	out, err := os.Create(reportFileName)
 	if err != nil {
 		log.Println("Error creating report:", err)
-		return
+		return false
 	}
 
-	defer out.Close()
-
 	writer := csv.NewWriter(out)
 
-	writer.WriteAll(reportForDate.Convert(true, true))
+	writer.WriteAll(reportForDate.Convert(true, addQuotes))
 
 	if err := writer.Error(); err != nil {
 		log.Println("error writing csv:", err)
-		return
-	}
-
-}
-
-// ReportEntry struct for the aggregated repprt entry
-// hh_id, device_id, event, ts, pg_id, pg_name, ch_num, ch_name, zipcode, country
-// 112961,2016-07-02 23:21:58,975540,"Oklahoma News Report",3,KETA,watch,79081,USA
-type ReportEntry struct {
-	hh_id     string
-	device_id string
-	event     string
-	ts        string
-	pg_id     string
-	pg_name   string
-	ch_num    string
-	ch_name   string
-	zipcode   string
-	country   string
-}
-
-// ReportEntryList list of ReportEntry
-type ReportEntryList []ReportEntry
-
-// Convert converts []ReportEntry into [][]string for csv file
-func (report ReportEntryList) Convert(headerOn bool, addQuotes bool) [][]string {
-	header := []string{"hh_id", "device_id", "event", "ts", "pg_id", "pg_name", "ch_num", "ch_name", "zipcode", "country"}
-	bodyAll := [][]string{}
-	quotes := ""
-
-	if headerOn {
-		bodyAll = append(bodyAll, header)
-	}
-
-	if addQuotes {
-		quotes = "\""
-	}
-
-	for _, entry := range report {
-		bodyAll = append(bodyAll,
-			[]string{
-				entry.hh_id,
-				entry.device_id,
-				entry.event,
-				entry.ts,
-				entry.pg_id,
-				quotes + entry.pg_name + quotes,
-				entry.ch_num,
-				entry.ch_name,
-				entry.zipcode,
-				entry.country,
-			})
+		out.Close()
+		return false
 	}
-	return bodyAll
-}
-
-// Len returns the length of the list - for Sortable Interface
-func (report ReportEntryList) Len() int {
-	return len(report)
-}
-
-// Less returns if a[i]<a[j] - for Sortable Interface
-func (report ReportEntryList) Less(i, j int) bool {
-	return report[i].ts < report[j].ts
-}
-
-// Swap swaps elements i and j - for Sortable Interface
-func (report ReportEntryList) Swap(i, j int) {
-	report[i], report[j] = report[j], report[i]
-}
 
-// Filter returns only the entries for given date
-func (report ReportEntryList) Filter(date string) ReportEntryList {
-	var reportForDate ReportEntryList
-	// 0123 45 67
-	// 2016 06 01
-	// 2016-06-01
-	date = date[:4] + "-" + date[4:6] + "-" + date[6:8]
-
-	for _, entry := range report {
-		if strings.Contains(entry.ts, date) {
-			reportForDate = append(reportForDate, entry)
-		}
+	if err := out.Close(); err != nil {
+		log.Println("error closing csv:", err)
+		return false
 	}
-
-	return reportForDate
+	return true
 }
 
 // ReadViewershipEntries reads hh count from a single file
-func ReadViewershipEntries(fileName string) []ReportEntry {
-	entries := []ReportEntry{}
+func ReadViewershipEntries(fileName string) []viewership.ReportEntry {
+	entries := []viewership.ReportEntry{}
 
 	entriesFile, err := os.Open(fileName)
 	if err != nil {
@@ -595,7 +746,16 @@ func ReadViewershipEntries(fileName string) []ReportEntry {
 		return entries
 	}
 
+	defer entriesFile.Close()
+
 	r := csv.NewReader(entriesFile)
+	columns, err := readColumnMap(r, fileName)
+	if err != nil {
+		log.Printf("Could not read header of viewership file: %s, Error: %s\n", fileName, err)
+		return entries
+	}
+	quarantine.Track(fileName)
+
 	records, err := r.ReadAll()
 	if err != nil {
 		log.Printf("Could not read viewership file: %s, Error: %s\n", fileName, err)
@@ -603,12 +763,13 @@ func ReadViewershipEntries(fileName string) []ReportEntry {
 	}
 
 	for i, record := range records {
-		// Skipping the first line - header
-		if i > 0 {
-			// 	---			---						0			1			2		3			4		5			6			7			8		9
-			// 	---			---						hh_id,   device_id,  event,    ts,         pg_id,   pg_name,   ch_num,    ch_name,   zipcode, country
-			entries = append(entries, ReportEntry{record[0], record[1], record[2], record[3], record[4], record[5], record[6], record[7], record[8], record[9]})
+		entry, err := columns.Entry(record)
+		if err != nil {
+			// the header is line 1
+			quarantine.Reject(fileName, i+2, err, record)
+			continue
 		}
+		entries = append(entries, entry)
 	}
 	if verbose {
 		log.Printf("Read: %d entries from %s \n", len(records), fileName)
@@ -617,8 +778,10 @@ func ReadViewershipEntries(fileName string) []ReportEntry {
 
 }
 
+// isFileToPush returns true for the files to merge: sorted .csv, or the downloaded .gz which were already sorted
 func isFileToPush(fileName string) bool {
-	return filepath.Ext(fileName) == ".csv"
+	ext := filepath.Ext(fileName)
+	return ext == ".csv" || ext == ".gz" || ext == ".gzip"
 }
 
 // ReportFailedFiles prints the report of failed to download files if any
@@ -632,15 +795,26 @@ func ReportFailedFiles(failedFilesList []string) {
 	}
 }
 
-func processSingleDownload(key string, wg *sync.WaitGroup) {
+// processSingleDownload downloads the object into the file named by its key, sorting it if sortFile is set,
+// and records it in the manifest
+func processSingleDownload(object ObjectInfo, manifest *Manifest, wg *sync.WaitGroup, sortFile bool) {
 	defer wg.Done()
+	key := object.Key
 	for i := 0; i < maxAttempts; i++ {
 		log.Println("Downloading: ", key)
-		if downloadFile(key) && unzipAndSortFile(key) {
+		path, ok := key, downloadFile(key)
+		if ok && sortFile {
+			path, ok = prepareFile(key)
+		}
+
+		if ok {
+			if err := manifest.Record(object, path); err != nil {
+				log.Println("Could not save download manifest: ", err)
+			}
 			if verbose {
 				log.Println("Successfully downloaded: ", key)
 			}
-			downloadedReportChannel <- true
+			downloadedReportChannel <- key
 			return
 		}
 
@@ -674,14 +848,7 @@ func downloadFile(filename string) bool {
 
 	defer file.Close()
 
-	downloader := s3manager.NewDownloader(session.New(&aws.Config{Region: aws.String(regionName)}))
-
-	numBytes, err := downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(filename),
-		})
-
+	numBytes, err := sourceStore.Get(filename, file)
 	if err != nil {
 		log.Printf("Failed to download file: %s, Error: %s ", filename, err)
 		return false
@@ -690,66 +857,3 @@ func downloadFile(filename string) bool {
 	log.Println("Downloaded file ", file.Name(), numBytes, " bytes")
 	return true
 }
-
-// unzipAndFilterSort unzips, sorts, and saves the original file:
-// 1. unzips into memory, convert into reportList
-// REMOVED 2. filters by the provided date
-// 3. sorts the file
-// 4. saves it
-func unzipAndSortFile(fileName string) bool {
-	// removing the filter part
-	//date = date[:4] + "-" + date[4:6] + "-" + date[6:8]
-
-	// 1. unzip the file
-	handle, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0660)
-
-	if err != nil {
-		log.Println("Error opening gzip file: ", err)
-		return false
-	}
-
-	zipReader, err := gzip.NewReader(handle)
-	if err != nil {
-		log.Println("Error: ", err)
-		return false
-	}
-
-	defer zipReader.Close()
-
-	// 1a. convert it into reportList and filter by date
-	r := csv.NewReader(zipReader)
-	records, err := r.ReadAll()
-	if err != nil {
-		log.Printf("Could not read viewership file: %s, Error: %s\n", fileName, err)
-		return false
-	}
-
-	var entries ReportEntryList
-
-	for i, record := range records {
-		// Skipping the first line - header
-		if i > 0 {
-			// 	---			---						0			1			2		3			4		5			6			7			8		9
-			// 	---			---						hh_id,   device_id,  event,    ts,         pg_id,   pg_name,   ch_num,    ch_name,   zipcode, country
-			entries = append(entries, ReportEntry{record[0], record[1], record[2], record[3], record[4], record[5], record[6], record[7], record[8], record[9]})
-		}
-	}
-
-	// 3. Sort the entries
-	sort.Sort(entries)
-
-	// 4. Save the file back
-	newFileName := ""
-	if strings.Contains(fileName, ".gzip") {
-		newFileName = strings.TrimSuffix(fileName, ".gzip")
-	} else if strings.Contains(fileName, ".gz") {
-		newFileName = strings.TrimSuffix(fileName, ".gz")
-	}
-	saveCSV(newFileName, entries)
-
-	if verbose {
-		log.Printf("Read: %d entries from %s \n", len(records), fileName)
-	}
-
-	return true
-}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestListSourceFiles checks only the files of the listed MSO's for the dates of the range are listed,
+// each date and MSO under its own prefix
+func TestListSourceFiles(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"})
+	row := "1,1-1,watch,2016-06-01 10:00:00,100,Show,4,CH4,79081,USA"
+
+	for _, date := range []string{"20160531", "20160601", "20160602", "20160603", "20160604", "20160605"} {
+		pipeline.addRawFile("htc", date, row)
+	}
+	pipeline.addRawFile("hc", "20160602", row)
+	// not in the MSO list
+	pipeline.addRawFile("armstrong_butler", "20160601", row)
+	// htc is the prefix of htc_test, only htc_<date>.csv files are the MSO's
+	pipeline.addRawFile("htc_test", "20160601", row)
+	writeTestFile(t, pipeline.source+"/cdw_viewership_reports/20160601/htc/readme.txt", "not a raw file")
+
+	_, dateRange := pipeline.setup("download", "-from", "2016-06-01", "-to", "2016-06-02", "-d", "2")
+
+	expected := []string{
+		rawKey("htc", "20160531"),
+		rawKey("htc", "20160601"),
+		rawKey("htc", "20160602"),
+		rawKey("hc", "20160602"),
+		rawKey("htc", "20160603"),
+		rawKey("htc", "20160604"),
+	}
+	if keys := objectKeys(listSourceFiles(dateRange)); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("listed %v, expected %v", keys, expected)
+	}
+}
+
+// TestGenerateReportDaysConcurrently checks the report days generated concurrently are the same as one by one
+func TestGenerateReportDaysConcurrently(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"})
+	pipeline.addRawFiles([]string{"htc", "hc"}, []string{"20160531", "20160601", "20160602", "20160603", "20160604", "20160605"}, 200)
+
+	args := []string{"-from", "2016-06-01", "-to", "2016-06-03", "-d", "2"}
+	if err := pipeline.run("run", append(args, "-w", "1")...); err != nil {
+		t.Fatal(err)
+	}
+	expected := pipeline.reportFiles("*_2016*.csv")
+	if len(expected) == 0 {
+		t.Fatal("no reports generated")
+	}
+
+	if err := pipeline.run("aggregate", append(args, "-w", "3", "-W", "0")...); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.run("hhcount", append(args, "-w", "3", "-W", "0")...); err != nil {
+		t.Fatal(err)
+	}
+	reports := pipeline.reportFiles("*_2016*.csv")
+
+	if len(reports) != len(expected) {
+		t.Errorf("generated %d reports concurrently, %d one by one", len(reports), len(expected))
+	}
+	for fileName, content := range expected {
+		if reports[fileName] != content {
+			t.Errorf("%s generated concurrently differs", fileName)
+		}
+	}
+}
+
+// TestDayWorkers checks there is at least one worker, and no more than -w
+func TestDayWorkers(t *testing.T) {
+	defer func(concurrency, memory int) { dayConcurrency, dayMemory = concurrency, memory }(dayConcurrency, dayMemory)
+
+	tests := []struct {
+		concurrency, memory int
+		min, max            int
+	}{
+		{0, 0, 1, 1},
+		{4, 0, 4, 4},
+		// more memory per day than there is
+		{4, 1 << 30, 1, 1},
+		{4, 1, 1, 4},
+	}
+
+	for _, test := range tests {
+		dayConcurrency, dayMemory = test.concurrency, test.memory
+		if workers := dayWorkers(); workers < test.min || workers > test.max {
+			t.Errorf("-w %d -W %d: %d workers, expected %d to %d", test.concurrency, test.memory, workers, test.min, test.max)
+		}
+	}
+}
+
+// addCountedRawFiles writes the raw files of the report day 2016-06-01 for the counts tests:
+// htc households 1 (two devices) and 2 (two programs), 3 only in the day before and the next day's file, hc household 9
+func (pipeline *testPipeline) addCountedRawFiles() {
+	pipeline.addRawFile("htc", "20160601",
+		"3,3-1,watch,2016-05-31 23:00:00,300,Movie,6,CH6,79081,USA",
+		"1,1-1,watch,2016-06-01 10:00:00,100,Show,4,CH4,79081,USA",
+		"1,1-2,watch,2016-06-01 11:00:00,100,Show,4,CH4,79081,USA",
+		"2,2-1,watch,2016-06-01 12:00:00,100,Show,4,CH4,79081,USA",
+		"2,2-1,watch,2016-06-01 13:00:00,200,News,5,CH5,79081,USA")
+	pipeline.addRawFile("htc", "20160602",
+		"3,3-1,watch,2016-06-01 23:30:00,100,Show Rerun,4,CH4,79081,USA",
+		"3,3-1,watch,2016-06-02 00:30:00,300,Movie,6,CH6,79081,USA")
+	pipeline.addRawFile("hc", "20160601",
+		"9,9-1,watch,2016-06-01 10:00:00,100,Show,4,CH4,79081,USA")
+}
+
+// TestProgramReachReport checks the distinct households and devices of the report day per MSO per program:
+// the same pg_id under the other pg_name is the other program
+func TestProgramReachReport(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"})
+	pipeline.addCountedRawFiles()
+
+	if err := pipeline.run("run", "-from", "2016-06-01", "-to", "2016-06-01", "-d", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "date,provider_code,pg_id,pg_name,hh_id_count,device_id_count\n" +
+		"2016-06-01,4000011,100,Show,1,1\n" +
+		"2016-06-01,4000002,100,Show,2,3\n" +
+		"2016-06-01,4000002,100,Show Rerun,1,1\n" +
+		"2016-06-01,4000002,200,News,1,1\n"
+	if reach := pipeline.reportFiles("program_reach_20160601.csv")["program_reach_20160601.csv"]; reach != expected {
+		t.Errorf("program reach:\n%s\nexpected:\n%s", reach, expected)
+	}
+}
+
+// TestDeviceCountsReport checks the households, devices and events counts of the report day per MSO,
+// and the distribution of the devices per household
+func TestDeviceCountsReport(t *testing.T) {
+	pipeline := newTestPipeline(t, MsoType{"4000002", "htc"}, MsoType{"4000011", "hc"}, MsoType{"4000003", "armstrong"})
+	pipeline.addCountedRawFiles()
+
+	if err := pipeline.run("run", "-from", "2016-06-01", "-to", "2016-06-01", "-d", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"hh_count_htc_20160601.csv": "date,provider_code,hh_id_count\n" +
+			"2016-06-01,4000002,3\n",
+		"device_count_htc_20160601.csv": "date,provider_code,hh_id_count,device_id_count,event_count\n" +
+			"2016-06-01,4000002,3,4,5\n",
+		"devices_per_hh_htc_20160601.csv": "date,provider_code,devices,hh_id_count\n" +
+			"2016-06-01,4000002,1,2\n" +
+			"2016-06-01,4000002,2,1\n",
+		"device_count_hc_20160601.csv": "date,provider_code,hh_id_count,device_id_count,event_count\n" +
+			"2016-06-01,4000011,1,1,1\n",
+		"devices_per_hh_hc_20160601.csv": "date,provider_code,devices,hh_id_count\n" +
+			"2016-06-01,4000011,1,1\n",
+		// no events, still reported
+		"device_count_armstrong_20160601.csv": "date,provider_code,hh_id_count,device_id_count,event_count\n" +
+			"2016-06-01,4000003,0,0,0\n",
+		"devices_per_hh_armstrong_20160601.csv": "date,provider_code,devices,hh_id_count\n",
+	}
+
+	reports := pipeline.reportFiles("*_20160601.csv")
+	for fileName, content := range expected {
+		if reports[fileName] != content {
+			t.Errorf("%s:\n%s\nexpected:\n%s", fileName, reports[fileName], content)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package viewership
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Columns are the columns of ReportEntry, in the order of the aggregated report
+var Columns = []string{"hh_id", "device_id", "event", "ts", "pg_id", "pg_name", "ch_num", "ch_name", "zipcode", "country"}
+
+const (
+	colHHID = iota
+	colDeviceID
+	colEvent
+	colTs
+	colPgID
+	colPgName
+	colChNum
+	colChName
+	colZipcode
+	colCountry
+)
+
+// ColumnMap maps the report columns to their positions in the records of a single file
+type ColumnMap struct {
+	index    []int
+	minWidth int
+}
+
+// IsReportColumn returns true if name is one of the report columns
+func IsReportColumn(name string) bool {
+	for _, column := range Columns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeColumn makes the header column name comparable: trimmed, lower case, without BOM
+func normalizeColumn(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+}
+
+// NewColumnMap checks the header and maps the report columns by name,
+// the column can be found under its own name or under the alias for it: report column -> column name in the file
+func NewColumnMap(header []string, aliases map[string]string) (*ColumnMap, error) {
+	positions := make(map[string]int)
+	for i, name := range header {
+		name = normalizeColumn(name)
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+
+	columns := &ColumnMap{index: make([]int, len(Columns))}
+	missing := []string{}
+
+	for i, column := range Columns {
+		position, ok := positions[column]
+		if alias, hasAlias := aliases[column]; hasAlias && !ok {
+			position, ok = positions[normalizeColumn(alias)]
+		}
+		if !ok {
+			missing = append(missing, column)
+			continue
+		}
+
+		columns.index[i] = position
+		if position+1 > columns.minWidth {
+			columns.minWidth = position + 1
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing columns in header: %s", strings.Join(missing, ", "))
+	}
+	return columns, nil
+}
+
+// Entry builds the report entry from the record
+func (columns *ColumnMap) Entry(record []string) (ReportEntry, error) {
+	if len(record) < columns.minWidth {
+		return noValueEntry, fmt.Errorf("expected %d fields, got %d", columns.minWidth, len(record))
+	}
+
+	fields := make([]string, len(columns.index))
+	for i, position := range columns.index {
+		fields[i] = record[position]
+	}
+	return ParseReportEntry(fields)
+}
+
+// ReadColumnMap reads the header of the file and maps its columns, using the aliases for the file
+func ReadColumnMap(r *csv.Reader, aliases map[string]string) (*ColumnMap, error) {
+	// the rows are checked against the header by the column map
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewColumnMap(header, aliases)
+}
+
+// IsParseError returns true for the csv error of a malformed row, the reading can go on after it
+func IsParseError(err error) bool {
+	_, ok := err.(*csv.ParseError)
+	return ok
+}
+
+// RecordLine returns the line of the last record read, for the error messages
+func RecordLine(r *csv.Reader) int {
+	line, _ := r.FieldPos(0)
+	return line
+}
+
+// ParseErrorLine returns the line of the csv parse error, or the line of the last record
+func ParseErrorLine(r *csv.Reader, err error) int {
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return parseError.Line
+	}
+	return RecordLine(r)
+}
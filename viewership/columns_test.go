@@ -0,0 +1,86 @@
+package viewership
+
+import (
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestReadColumnMap checks the columns are found by name in any order, under their aliases,
+// and the missing ones are reported
+func TestReadColumnMap(t *testing.T) {
+	expected := []string{"1", "1-1", "watch", "2016-06-01 00:00:01", "100", "Show", "4", "CH4", "79081", "USA"}
+
+	tests := []struct {
+		name    string
+		aliases map[string]string
+		content string
+		err     string
+	}{
+		{"report order", nil,
+			"hh_id,device_id,event,ts,pg_id,pg_name,ch_num,ch_name,zipcode,country\n" +
+				"1,1-1,watch,2016-06-01 00:00:01,100,Show,4,CH4,79081,USA\n", ""},
+		{"reordered", nil,
+			"ts,country,event,hh_id,ch_name,device_id,zipcode,pg_name,ch_num,pg_id\n" +
+				"2016-06-01 00:00:01,USA,watch,1,CH4,1-1,79081,Show,4,100\n", ""},
+		{"BOM, case and spaces", nil,
+			"\ufeffHH_ID, Device_Id ,EVENT,ts,pg_id,pg_name,ch_num,ch_name,zipcode,country\n" +
+				"1,1-1,watch,2016-06-01 00:00:01,100,Show,4,CH4,79081,USA\n", ""},
+		{"extra columns", nil,
+			"region,hh_id,device_id,event,ts,pg_id,pg_name,ch_num,ch_name,zipcode,country,extra\n" +
+				"west,1,1-1,watch,2016-06-01 00:00:01,100,Show,4,CH4,79081,USA,x\n", ""},
+		{"renamed", map[string]string{"hh_id": "household", "ts": "Event_Time", "ch_num": "channel"},
+			"household,device_id,event,event_time,pg_id,pg_name,channel,ch_name,zipcode,country\n" +
+				"1,1-1,watch,2016-06-01 00:00:01,100,Show,4,CH4,79081,USA\n", ""},
+		{"renamed and reordered", map[string]string{"hh_id": "household", "zipcode": "zip"},
+			"zip,event,household,ts,device_id,country,pg_id,ch_num,pg_name,ch_name\n" +
+				"79081,watch,1,2016-06-01 00:00:01,1-1,USA,100,4,Show,CH4\n", ""},
+		{"own name before the alias", map[string]string{"hh_id": "household"},
+			"household,hh_id,device_id,event,ts,pg_id,pg_name,ch_num,ch_name,zipcode,country\n" +
+				"2,1,1-1,watch,2016-06-01 00:00:01,100,Show,4,CH4,79081,USA\n", ""},
+		{"renamed without alias", nil,
+			"household,device_id,event,event_time,pg_id,pg_name,ch_num,ch_name,zipcode,country\n", "missing columns in header: hh_id, ts"},
+		{"alias not in the header", map[string]string{"hh_id": "household"},
+			"hh,device_id,event,ts,pg_id,pg_name,ch_num,ch_name,zipcode,country\n", "missing columns in header: hh_id"},
+	}
+
+	for _, test := range tests {
+		r := csv.NewReader(strings.NewReader(test.content))
+		columns, err := ReadColumnMap(r, test.aliases)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, expected %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		record, err := r.Read()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		entry, err := columns.Entry(record)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if fields := entry.Format(); !reflect.DeepEqual(fields, expected) {
+			t.Errorf("%s: %v, expected %v", test.name, fields, expected)
+		}
+	}
+}
+
+// TestColumnMapShortRecord checks the record without the rightmost mapped column is rejected
+func TestColumnMapShortRecord(t *testing.T) {
+	columns, err := NewColumnMap([]string{"hh_id", "device_id", "event", "ts", "pg_id", "pg_name", "ch_num", "ch_name", "zipcode", "country"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := columns.Entry([]string{"1", "1-1", "watch", "2016-06-01 00:00:01"}); err == nil {
+		t.Error("short record accepted")
+	}
+}
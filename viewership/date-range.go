@@ -0,0 +1,89 @@
+package viewership
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateFormat is the format of the report days and the folders of the raw files
+const DateFormat = "20060102"
+
+// DateRange generates the list of the dates to read for the report days dateFrom-dateTo:
+// starting one day before (from - 1) -to- N daysAfter (to + daysAfter)
+func DateRange(dateFrom, dateTo string, daysAfter int) ([]string, error) {
+	dtFrom, err := time.Parse(DateFormat, dateFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date from: %s", dateFrom)
+	}
+
+	dtTo, err := time.Parse(DateFormat, dateTo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date to: %s", dateTo)
+	}
+
+	if dtFrom.After(dtTo) {
+		return nil, fmt.Errorf("date from %s is after date to %s", dateFrom, dateTo)
+	}
+
+	dtFrom = dtFrom.AddDate(0, 0, -1)
+	dtTo = dtTo.AddDate(0, 0, daysAfter)
+
+	dates := []string{}
+	for dt := dtFrom; !dt.After(dtTo); dt = dt.AddDate(0, 0, 1) {
+		dates = append(dates, dt.Format(DateFormat))
+	}
+	return dates, nil
+}
+
+// ReportDayIndexes returns the indexes of the report days in the dateRange:
+// report days start from dateFrom (one day after the range start),
+// and each needs daysForward days after it in the range
+func ReportDayIndexes(dateFrom string, dateRange []string, daysForward int) []int {
+	indexes := []int{}
+	for i := range dateRange {
+		if dateRange[i] >= dateFrom && i+daysForward < len(dateRange) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// ReportDays returns the report days in the dateRange
+func ReportDays(dateFrom string, dateRange []string, daysForward int) []string {
+	reportDays := []string{}
+	for _, i := range ReportDayIndexes(dateFrom, dateRange, daysForward) {
+		reportDays = append(reportDays, dateRange[i])
+	}
+	return reportDays
+}
+
+// ReportDayDates returns the dates in dateRange to read for the report day dateRange[reportIndex]:
+// one day before -up-to- N daysForward
+func ReportDayDates(dateRange []string, reportIndex int, daysForward int) []string {
+	return dateRange[reportIndex-1 : reportIndex+daysForward+1]
+}
+
+// AffectedReportDays returns the report days reading any of the dates:
+// the report day reads one day before -up-to- daysAfter days after it,
+// so the date affects the report days from date - daysAfter -to- date + 1
+func AffectedReportDays(reportDays, dates []string, daysAfter int) []string {
+	changed := make(map[string]bool)
+	for _, date := range dates {
+		changed[date] = true
+	}
+
+	affected := []string{}
+	for _, reportDay := range reportDays {
+		dt, err := time.Parse(DateFormat, reportDay)
+		if err != nil {
+			continue
+		}
+		for i := -1; i <= daysAfter; i++ {
+			if changed[dt.AddDate(0, 0, i).Format(DateFormat)] {
+				affected = append(affected, reportDay)
+				break
+			}
+		}
+	}
+	return affected
+}
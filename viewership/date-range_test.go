@@ -0,0 +1,33 @@
+package viewership
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestAffectedReportDays checks the date affects the report days from date - daysAfter -to- date + 1
+func TestAffectedReportDays(t *testing.T) {
+	reportDays := []string{"20160601", "20160602", "20160603", "20160604"}
+
+	tests := []struct {
+		dates     []string
+		daysAfter int
+		affected  []string
+	}{
+		{[]string{"20160602"}, 1, []string{"20160601", "20160602", "20160603"}},
+		{[]string{"20160602"}, 2, []string{"20160601", "20160602", "20160603"}},
+		{[]string{"20160604"}, 2, []string{"20160602", "20160603", "20160604"}},
+		// the day before the first report day, and after the last one
+		{[]string{"20160531"}, 1, []string{"20160601"}},
+		{[]string{"20160606"}, 1, []string{}},
+		{[]string{"20160606"}, 2, []string{"20160604"}},
+		{[]string{"20160601", "20160604"}, 1, []string{"20160601", "20160602", "20160603", "20160604"}},
+		{[]string{}, 1, []string{}},
+	}
+
+	for _, test := range tests {
+		if affected := AffectedReportDays(reportDays, test.dates, test.daysAfter); !reflect.DeepEqual(affected, test.affected) {
+			t.Errorf("AffectedReportDays(%v, %d) = %v, expected %v", test.dates, test.daysAfter, affected, test.affected)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Package viewership is the aggregation engine of the viewership-aggregator:
+// reading the viewership files into typed ReportEntry records, k-way merging the sorted files
+// by timestamp with FilesPack, filtering a report day and counting the unique households
+// with AggregatedReport.
+//
+// Pattern to use:
+//
+//	pack := viewership.NewFilesPack(map[string][]string{"htc": fileNames}, viewership.Options{})
+//	report, err := viewership.NewAggregatedReport("aggregated_viewership_20160601.csv", []string{"htc"})
+//	if err == nil {
+//		report.ProcessFiles(pack, "20160601")
+//		counts := report.HHCounts()
+//		. . .
+//	}
+package viewership
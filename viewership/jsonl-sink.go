@@ -0,0 +1,88 @@
+package viewership
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// jsonEvent is the JSON Lines record of the event: ts in RFC 3339, ch_num a number or null
+type jsonEvent struct {
+	ProviderCode  string    `json:"provider_code"`
+	Mso           string    `json:"mso"`
+	HHID          string    `json:"hh_id"`
+	DeviceID      string    `json:"device_id"`
+	Event         string    `json:"event"`
+	Timestamp     time.Time `json:"ts"`
+	ProgramID     string    `json:"pg_id"`
+	ProgramName   string    `json:"pg_name"`
+	ChannelNumber *int      `json:"ch_num"`
+	ChannelName   string    `json:"ch_name"`
+	Zipcode       string    `json:"zipcode"`
+	Country       string    `json:"country"`
+}
+
+// JSONLSink writes the events as newline-delimited JSON, one event per line, with the provider code
+type JSONLSink struct {
+	file          *os.File
+	writer        *bufio.Writer
+	encoder       *json.Encoder
+	providerCodes map[string]string
+}
+
+// NewJSONLSink creates the JSON Lines file
+func NewJSONLSink(fileName string, options SinkOptions) (*JSONLSink, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+
+	return &JSONLSink{
+		file:          file,
+		writer:        writer,
+		encoder:       encoder,
+		providerCodes: options.ProviderCodes,
+	}, nil
+}
+
+// Write writes the events, a line each
+func (sink *JSONLSink) Write(events []Event) error {
+	for _, event := range events {
+		record := jsonEvent{
+			ProviderCode: sink.providerCodes[event.Mso],
+			Mso:          event.Mso,
+			HHID:         event.HHID,
+			DeviceID:     event.DeviceID,
+			Event:        event.ReportEntry.Event,
+			Timestamp:    event.Timestamp,
+			ProgramID:    event.ProgramID,
+			ProgramName:  event.ProgramName,
+			ChannelName:  event.ChannelName,
+			Zipcode:      event.Zipcode,
+			Country:      event.Country,
+		}
+		if event.HasChannel {
+			chNum := event.ChannelNumber
+			record.ChannelNumber = &chNum
+		}
+
+		if err := sink.encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the file
+func (sink *JSONLSink) Close() error {
+	err := sink.writer.Flush()
+	if closeErr := sink.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package viewership
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestJSONLSink checks each event is a line of a JSON object with the report columns, the MSO and its provider code:
+// ts in RFC 3339, ch_num a number or null
+func TestJSONLSink(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "aggregated_viewership_20160601.jsonl")
+	noChannel := testEntry(t, "2", "2-1", "2016-06-01 11:00:00", 0)
+	noChannel.HasChannel = false
+	noChannel.ProgramName = "Tom & Jerry <HD>"
+
+	sink, err := NewJSONLSink(fileName, SinkOptions{ProviderCodes: map[string]string{"htc": "4000002"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write([]Event{
+		{Mso: "htc", ReportEntry: testEntry(t, "1", "1-1", "2016-06-01 10:00:00", 4)},
+		{Mso: "htc", ReportEntry: noChannel},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// not in the provider codes
+	if err := sink.Write([]Event{{Mso: "hc", ReportEntry: testEntry(t, "3", "3-1", "2016-06-01 12:00:00", 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []map[string]interface{}{
+		{"provider_code": "4000002", "mso": "htc", "hh_id": "1", "device_id": "1-1", "event": "watch", "ts": "2016-06-01T10:00:00Z",
+			"pg_id": "100", "pg_name": "Show", "ch_num": 4.0, "ch_name": "CH", "zipcode": "79081", "country": "USA"},
+		{"provider_code": "4000002", "mso": "htc", "hh_id": "2", "device_id": "2-1", "event": "watch", "ts": "2016-06-01T11:00:00Z",
+			"pg_id": "100", "pg_name": "Tom & Jerry <HD>", "ch_num": nil, "ch_name": "CH", "zipcode": "79081", "country": "USA"},
+		{"provider_code": "", "mso": "hc", "hh_id": "3", "device_id": "3-1", "event": "watch", "ts": "2016-06-01T12:00:00Z",
+			"pg_id": "100", "pg_name": "Show", "ch_num": 0.0, "ch_name": "CH", "zipcode": "79081", "country": "USA"},
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for ; scanner.Scan(); lines++ {
+		line := scanner.Text()
+		if lines >= len(expected) {
+			t.Errorf("line %d: unexpected %s", lines+1, line)
+			continue
+		}
+
+		record := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Errorf("line %d: %s", lines+1, err)
+			continue
+		}
+		if !reflect.DeepEqual(record, expected[lines]) {
+			t.Errorf("line %d: %v, expected %v", lines+1, record, expected[lines])
+		}
+		if strings.Contains(line, `\u0026`) {
+			t.Errorf("line %d: HTML escaped %s", lines+1, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lines != len(expected) {
+		t.Errorf("%d lines, expected %d", lines, len(expected))
+	}
+}
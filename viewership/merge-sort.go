@@ -0,0 +1,709 @@
+package viewership
+
+import (
+	"compress/gzip"
+	"container/heap"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	maxLines = 1000
+	// MaxLinesAggregated is the number of the entries buffered before writing them into the report file
+	MaxLinesAggregated = 10000
+)
+
+// Rejecter receives the rows rejected while reading the viewership files
+type Rejecter interface {
+	// Track receives every file read, once its header is mapped, with or without rows rejected
+	Track(fileName string)
+	Reject(fileName string, line int, reason error, record []string)
+}
+
+// Options are the options for reading the viewership files
+type Options struct {
+	// ColumnAliases maps MSO name to its column names: report column -> column name in the MSO's files
+	ColumnAliases map[string]map[string]string
+	// Rejecter receives the malformed rows, they are skipped if not provided
+	Rejecter Rejecter
+	// Verbose logs the reading progress
+	Verbose bool
+}
+
+func (options Options) track(fileName string) {
+	if options.Rejecter != nil {
+		options.Rejecter.Track(fileName)
+	}
+}
+
+func (options Options) reject(fileName string, line int, reason error, record []string) {
+	if options.Rejecter != nil {
+		options.Rejecter.Reject(fileName, line, reason, record)
+	}
+}
+
+// FileStruct wraps a single file into a buffered read-structure to be
+// used as one of the inputs in merge-sort (of previously sorted files)
+type FileStruct struct {
+	records     ReportEntryList
+	recordsRead int
+	fileName    string
+	mso         string
+	options     Options
+	csvReader   *csv.Reader
+	entriesFile *os.File
+	zipReader   *gzip.Reader
+	columns     *ColumnMap
+	ended       bool
+	// err is the error opening or reading the file, ending it before its end
+	err error
+}
+
+// NewFileStruct initializes and returns new wrapper instance for fileName of the MSO,
+// the MSO's column aliases are used to map the columns
+//
+// Pattern to use:
+// fileStruct := NewFileStruct("sourceFileName.csv", "htc", Options{})
+// if fileStruct.Init() {
+//		ts, err := fileStruct.PeeknextItemTimestamp()
+//
+//		if err != nill { return "End of file"}
+//		. . .
+// 		item := fileStruct.PopNextItem()
+//		. . .
+//		fileStruct.Close()
+//
+// }
+func NewFileStruct(fileName, mso string, options Options) *FileStruct {
+	fileStruct := &FileStruct{
+		fileName:    fileName,
+		mso:         mso,
+		options:     options,
+		recordsRead: 0,
+		ended:       false,
+	}
+	return fileStruct
+}
+
+// Init initializes the fileStruct Opens the file, and populates the first block
+func (file *FileStruct) Init() bool {
+	var err error
+	file.entriesFile, err = os.Open(file.fileName)
+	if err != nil {
+		log.Printf("Could not open viewership file: %s, Error: %s\n", file.fileName, err)
+		file.ended = true
+		file.err = err
+		return false
+	}
+
+	// the sorted source files can be merged while still gzipped
+	if IsGzipFile(file.fileName) {
+		file.zipReader, err = gzip.NewReader(file.entriesFile)
+		if err != nil {
+			log.Printf("Could not open gzip file: %s, Error: %s\n", file.fileName, err)
+			file.entriesFile.Close()
+			file.ended = true
+			file.err = err
+			return false
+		}
+		file.csvReader = csv.NewReader(file.zipReader)
+	} else {
+		file.csvReader = csv.NewReader(file.entriesFile)
+	}
+
+	// Mapping the columns by the header
+	file.columns, err = ReadColumnMap(file.csvReader, file.options.ColumnAliases[file.mso])
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Could not read header of viewership file: %s, Error: %s\n", file.fileName, err)
+			file.err = err
+		}
+		file.Close()
+		return false
+	}
+	file.options.track(file.fileName)
+	file.ReadNextBlock()
+	return true
+}
+
+// Close closes the file
+func (file *FileStruct) Close() {
+	file.ended = true
+	if file.zipReader != nil {
+		file.zipReader.Close()
+	}
+	defer file.entriesFile.Close()
+}
+
+// IsGzipFile returns true for the gzipped viewership file: .gz or .gzip
+func IsGzipFile(fileName string) bool {
+	ext := filepath.Ext(fileName)
+	return ext == ".gz" || ext == ".gzip"
+}
+
+// PeekNextItemTimestamp gets the timestamp of the next item in the file
+func (file *FileStruct) PeekNextItemTimestamp() (time.Time, error) {
+	if file.ended || len(file.records) == 0 {
+		file.ended = true
+		defer file.Close()
+		return time.Time{}, errors.New("EOF")
+	}
+	return file.records[0].Timestamp, nil
+}
+
+var noValueEntry = ReportEntry{}
+
+// PopNextItem returns the next itme in the file, and moves to next entry/reads into the buffer, if needed
+func (file *FileStruct) PopNextItem() ReportEntry {
+	if file.Ended() {
+		return noValueEntry
+	}
+	entry := file.records[0]
+
+	if len(file.records) > 0 {
+		file.records = file.records[1:]
+	}
+
+	if len(file.records) == 0 {
+		file.ReadNextBlock()
+	}
+	return entry
+}
+
+// ReadNextBlock reads the next N valid entries from the file into the buffer, the rejected rows are not counted,
+// so the block is short only at the end of the file
+// Returns the number of the entries read
+func (file *FileStruct) ReadNextBlock() int {
+	read := 0
+	for read < maxLines {
+
+		record, err := file.csvReader.Read()
+
+		if err == io.EOF {
+			break
+		} else if IsParseError(err) {
+			file.options.reject(file.fileName, ParseErrorLine(file.csvReader, err), err, record)
+			continue
+		} else if err != nil {
+			log.Printf("Could not read viewership file: %s, Error: %s\n", file.fileName, err)
+			file.ended = true
+			file.err = err
+			return -1
+		}
+
+		entry, err := file.columns.Entry(record)
+		if err != nil {
+			file.options.reject(file.fileName, RecordLine(file.csvReader), err, record)
+			continue
+		}
+		file.records = append(file.records, entry)
+		read++
+	}
+	if file.options.Verbose {
+		log.Printf("Read: %d entries from %s \n", len(file.records), file.fileName)
+	}
+	return read
+}
+
+// Ended returns false if no more entries in this file
+func (file *FileStruct) Ended() bool {
+	return file.ended
+}
+
+// Err returns the error opening or reading the file, nil if read to its end
+func (file *FileStruct) Err() error {
+	if file.err != nil {
+		return fmt.Errorf("%s: %s", file.fileName, file.err)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+
+// FilesPack aggregates a collection of source files to be merge-sorted
+// The files are kept in a priority queue by the timestamp of their next entry
+type FilesPack struct {
+	queue packQueue
+	files []*FileStruct
+}
+
+// packItem is a single file in the pack's priority queue
+type packItem struct {
+	file  *FileStruct
+	mso   string
+	order int
+	ts    time.Time
+}
+
+// packQueue is a min-heap of files by the timestamp of their next entry,
+// ties are broken by MSO name, then by the order the file was added to the pack
+type packQueue []*packItem
+
+// Len returns the number of files in the queue - for heap Interface
+func (queue packQueue) Len() int {
+	return len(queue)
+}
+
+// Less returns if queue[i]<queue[j] - for heap Interface
+func (queue packQueue) Less(i, j int) bool {
+	if !queue[i].ts.Equal(queue[j].ts) {
+		return queue[i].ts.Before(queue[j].ts)
+	}
+	if queue[i].mso != queue[j].mso {
+		return queue[i].mso < queue[j].mso
+	}
+	return queue[i].order < queue[j].order
+}
+
+// Swap swaps elements i and j - for heap Interface
+func (queue packQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+}
+
+// Push adds the item to the queue - for heap Interface
+func (queue *packQueue) Push(x interface{}) {
+	*queue = append(*queue, x.(*packItem))
+}
+
+// Pop removes the last item from the queue - for heap Interface
+func (queue *packQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// NewFilesPack creates and initializes new pack of files: MSO name -> the MSO's files
+func NewFilesPack(fileNames map[string][]string, options Options) *FilesPack {
+	filePack := &FilesPack{}
+
+	// adding in a fixed order for deterministic tie-breaking
+	msos := make([]string, 0, len(fileNames))
+	for mso := range fileNames {
+		msos = append(msos, mso)
+	}
+	sort.Strings(msos)
+
+	order := 0
+	for _, mso := range msos {
+		for _, fileName := range fileNames[mso] {
+			fileStruct := NewFileStruct(fileName, mso, options)
+			filePack.files = append(filePack.files, fileStruct)
+			if !fileStruct.Init() {
+				continue
+			}
+
+			ts, err := fileStruct.PeekNextItemTimestamp()
+			if err != nil {
+				continue
+			}
+
+			filePack.queue = append(filePack.queue, &packItem{
+				file:  fileStruct,
+				mso:   mso,
+				order: order,
+				ts:    ts,
+			})
+			order++
+		}
+	}
+	heap.Init(&filePack.queue)
+
+	return filePack
+}
+
+// NextMinItem returns the next report entry accross all files in the pack, having the min timestamp
+// along with MSO name for that entry
+func (filePack *FilesPack) NextMinItem() (ReportEntry, string) {
+	if len(filePack.queue) == 0 {
+		return noValueEntry, ""
+	}
+
+	top := filePack.queue[0]
+	entry := top.file.PopNextItem()
+
+	ts, err := top.file.PeekNextItemTimestamp()
+	if err != nil {
+		// the file is done, drop it from the queue
+		heap.Pop(&filePack.queue)
+	} else {
+		top.ts = ts
+		heap.Fix(&filePack.queue, 0)
+	}
+
+	return entry, top.mso
+}
+
+// Err returns the first error opening or reading the files of the pack,
+// the file failed to read ends early, so the merge is incomplete
+func (filePack *FilesPack) Err() error {
+	for _, file := range filePack.files {
+		if err := file.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+
+// AggregatedReport wraps the event sinks allowing buffered writes into the resulting files
+type AggregatedReport struct {
+	sinks      []EventSink
+	err        error
+	buffer     []Event
+	hhCounts   map[string]map[string]map[string]bool
+	events     map[string]int
+	reportDate string
+
+	// dedup drops the duplicate events, keeping the keys seen at seenTs
+	dedup      bool
+	duplicates map[string]int
+	seen       map[string]bool
+	seenTs     time.Time
+
+	// sessions builds the viewing sessions of the report day, if set
+	sessions *SessionBuilder
+	// programs collects the program reach of the report day, if set
+	programs programsReach
+	// tuning keeps the devices' tuning state for the quarter-hour ratings, if set
+	tuning      *SessionBuilder
+	tuningSince time.Duration
+}
+
+// NewAggregatedReport creates and initializes an instance of aggregeted report file
+// counting the households for the MSO's, including the ones without any entries
+// With empty fileName only the counts are aggregated, and no report file is written
+func NewAggregatedReport(fileName string, msos []string) (*AggregatedReport, error) {
+	if fileName == "" {
+		return NewAggregatedReportSink(nil, msos), nil
+	}
+
+	sink, err := NewCSVSink(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return NewAggregatedReportSink(sink, msos), nil
+}
+
+// NewAggregatedReportSink creates and initializes an instance of aggregeted report writing into the sink
+// With nil sink only the counts are aggregated
+func NewAggregatedReportSink(sink EventSink, msos []string) *AggregatedReport {
+	aggregatedReport := &AggregatedReport{
+		buffer: []Event{},
+	}
+	if sink != nil {
+		aggregatedReport.sinks = append(aggregatedReport.sinks, sink)
+	}
+
+	aggregatedReport.hhCounts = make(map[string]map[string]map[string]bool)
+	aggregatedReport.events = make(map[string]int)
+	aggregatedReport.duplicates = make(map[string]int)
+	for _, mso := range msos {
+		aggregatedReport.hhCounts[mso] = make(map[string]map[string]bool)
+		aggregatedReport.events[mso] = 0
+		aggregatedReport.duplicates[mso] = 0
+	}
+	return aggregatedReport
+}
+
+// AddSink adds the sink receiving the events alongside the report file, and the counts if it is a CountsSink
+func (aggregated *AggregatedReport) AddSink(sink EventSink) {
+	aggregated.sinks = append(aggregated.sinks, sink)
+}
+
+// SetDedup enables dropping the duplicate events of the report day, and of the tuning around it for the ratings:
+// the same (mso, hh_id, device_id, event, ts, ch_num) re-sent by the MSO in the overlapping daily files
+func (aggregated *AggregatedReport) SetDedup(dedup bool) {
+	aggregated.dedup = dedup
+}
+
+// SetSessions passes the events of the report day to the sessions builder
+func (aggregated *AggregatedReport) SetSessions(sessions *SessionBuilder) {
+	aggregated.sessions = sessions
+}
+
+// SetProgramReach enables counting the distinct households and devices per MSO per program
+func (aggregated *AggregatedReport) SetProgramReach(programReach bool) {
+	if programReach {
+		aggregated.programs = make(programsReach)
+	} else {
+		aggregated.programs = nil
+	}
+}
+
+// SetRatings passes the devices' tuning into the quarter-hour ratings: a device stays tuned to the channel
+// until its next event, up to idleTimeout after its last event
+// The events up to idleTimeout around the report day are used, so the tuning goes across midnight
+func (aggregated *AggregatedReport) SetRatings(ratings *QuarterHourRatings, idleTimeout time.Duration) {
+	aggregated.tuning = NewSessionBuilder(idleTimeout, 0, ratings.AddSession)
+	aggregated.tuningSince = idleTimeout
+}
+
+// isDuplicate returns true if the MSO's event was already seen,
+// the merge is ordered by ts, so only the keys of the current ts are kept
+func (aggregated *AggregatedReport) isDuplicate(mso string, entry ReportEntry) bool {
+	if !entry.Timestamp.Equal(aggregated.seenTs) {
+		aggregated.seenTs = entry.Timestamp
+		aggregated.seen = make(map[string]bool)
+	}
+
+	key := mso + "\x00" + entry.dedupKey()
+	if aggregated.seen[key] {
+		return true
+	}
+	aggregated.seen[key] = true
+	return false
+}
+
+// ProcessFiles processes files pack merge-sort and saves the aggregated report
+func (aggregated *AggregatedReport) ProcessFiles(pack *FilesPack, forDate string) {
+
+	// 0123 45 67
+	// 2016 06 01
+	// 2016-06-01
+	aggregated.reportDate = forDate[:4] + "-" + forDate[4:6] + "-" + forDate[6:8]
+
+	dayStart, dayEnd, err := ParseReportDay(forDate)
+	if err != nil {
+		log.Printf("Invalid report date %s: %s\n", forDate, err)
+		aggregated.setErr(err)
+		aggregated.Close()
+		return
+	}
+
+	for {
+		nextItem, mso := pack.NextMinItem()
+
+		if nextItem.IsZero() {
+			break
+		}
+
+		inDay := !nextItem.Timestamp.Before(dayStart) && nextItem.Timestamp.Before(dayEnd)
+		inTuning := aggregated.tuning != nil && !nextItem.Timestamp.Before(dayStart.Add(-aggregated.tuningSince)) &&
+			nextItem.Timestamp.Before(dayEnd.Add(aggregated.tuningSince))
+		if !inDay && !inTuning {
+			continue
+		}
+
+		// the duplicates are dropped before the tuning too, only the report day's are counted
+		if aggregated.dedup && aggregated.isDuplicate(mso, nextItem) {
+			if inDay {
+				aggregated.duplicates[mso]++
+			}
+			continue
+		}
+
+		if inTuning {
+			aggregated.tuning.Add(mso, nextItem)
+		}
+
+		if inDay {
+			aggregated.WriteEntry(mso, nextItem)
+			aggregated.count(mso, nextItem)
+
+			if aggregated.sessions != nil {
+				aggregated.sessions.Add(mso, nextItem)
+			}
+			if aggregated.programs != nil {
+				aggregated.programs.add(mso, nextItem)
+			}
+		}
+	}
+	// the files failed to read end early, the report day is incomplete
+	if err := pack.Err(); err != nil {
+		aggregated.setErr(err)
+	}
+
+	if aggregated.sessions != nil {
+		aggregated.sessions.Flush()
+	}
+	if aggregated.tuning != nil {
+		aggregated.tuning.Flush()
+	}
+
+	aggregated.writeBuffer()
+	aggregated.writeCounts()
+	aggregated.Close()
+}
+
+// ReportDate returns the processed report day as 2016-06-01
+func (aggregated *AggregatedReport) ReportDate() string {
+	return aggregated.reportDate
+}
+
+// HHCounts returns the number of the unique households per MSO for the processed report day
+func (aggregated *AggregatedReport) HHCounts() map[string]int {
+	counts := make(map[string]int)
+	for mso, hhs := range aggregated.hhCounts {
+		counts[mso] = len(hhs)
+	}
+	return counts
+}
+
+// MsoCounts are the MSO's counts for the report day
+type MsoCounts struct {
+	Households int
+	// Devices are the distinct devices of the households
+	Devices int
+	Events  int
+	// DevicesPerHousehold is the distribution: the number of devices -> the number of households having them
+	DevicesPerHousehold map[int]int
+}
+
+// count counts the MSO's event, its household and its device
+func (aggregated *AggregatedReport) count(mso string, entry ReportEntry) {
+	hhs, ok := aggregated.hhCounts[mso]
+	if !ok {
+		hhs = make(map[string]map[string]bool)
+		aggregated.hhCounts[mso] = hhs
+	}
+
+	devices, ok := hhs[entry.HHID]
+	if !ok {
+		devices = make(map[string]bool)
+		hhs[entry.HHID] = devices
+	}
+
+	devices[entry.DeviceID] = true
+	aggregated.events[mso]++
+}
+
+// Counts returns the households, devices and events counts per MSO for the processed report day
+func (aggregated *AggregatedReport) Counts() map[string]MsoCounts {
+	counts := make(map[string]MsoCounts)
+	for mso, hhs := range aggregated.hhCounts {
+		msoCounts := MsoCounts{
+			Households:          len(hhs),
+			Events:              aggregated.events[mso],
+			DevicesPerHousehold: make(map[int]int),
+		}
+		for _, devices := range hhs {
+			msoCounts.Devices += len(devices)
+			msoCounts.DevicesPerHousehold[len(devices)]++
+		}
+		counts[mso] = msoCounts
+	}
+	return counts
+}
+
+// ProgramReach returns the distinct households and devices per MSO per program for the processed report day,
+// ordered by MSO and program
+func (aggregated *AggregatedReport) ProgramReach() []ProgramReach {
+	return aggregated.programs.list()
+}
+
+// Duplicates returns the number of the duplicate events dropped per MSO for the processed report day
+func (aggregated *AggregatedReport) Duplicates() map[string]int {
+	duplicates := make(map[string]int)
+	for mso, count := range aggregated.duplicates {
+		duplicates[mso] = count
+	}
+	return duplicates
+}
+
+// WriteEntry writes the MSO's entry to the buffer, if buffer has NN values, flush to the disk
+func (aggregated *AggregatedReport) WriteEntry(mso string, entry ReportEntry) bool {
+	if len(aggregated.sinks) == 0 {
+		return true
+	}
+
+	aggregated.buffer = append(aggregated.buffer, Event{Mso: mso, ReportEntry: entry})
+
+	if len(aggregated.buffer) > MaxLinesAggregated {
+		aggregated.writeBuffer()
+		aggregated.buffer = aggregated.buffer[:0]
+	}
+	return true
+}
+
+// WriteCSV is a utility func to write [][]string to a file->fileName,
+// creating the file or appending to the existing one
+func WriteCSV(filename string, content [][]string, createFile bool) bool {
+	var f *os.File
+	var err error
+
+	if createFile {
+		if f, err = os.Create(filename); err != nil {
+			log.Println("error creating file:", err)
+			return false
+		}
+	} else {
+		if f, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, os.ModeAppend); err != nil {
+			log.Println("error opening file to add csv:", err)
+			return false
+		}
+	}
+
+	writer := csv.NewWriter(f)
+
+	writer.WriteAll(content)
+
+	if err = writer.Error(); err != nil {
+		log.Println("error writing csv:", err)
+		return false
+	}
+
+	writer.Flush()
+	f.Close()
+	return true
+}
+
+// Flush the buffer to the sinks
+func (aggregated *AggregatedReport) writeBuffer() bool {
+	if len(aggregated.buffer) == 0 {
+		return true
+	}
+	ok := true
+	for _, sink := range aggregated.sinks {
+		if err := sink.Write(aggregated.buffer); err != nil {
+			log.Println("error writing aggregated report:", err)
+			aggregated.setErr(err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// setErr keeps the first error writing into the sinks
+func (aggregated *AggregatedReport) setErr(err error) {
+	if aggregated.err == nil {
+		aggregated.err = err
+	}
+}
+
+// Err returns the first error writing into the sinks, nil if the report is written completely
+func (aggregated *AggregatedReport) Err() error {
+	return aggregated.err
+}
+
+// writeCounts passes the counts of the report day to the sinks taking them
+func (aggregated *AggregatedReport) writeCounts() {
+	for _, sink := range aggregated.sinks {
+		if countsSink, ok := sink.(CountsSink); ok {
+			if err := countsSink.WriteCounts(aggregated.reportDate, aggregated.Counts()); err != nil {
+				log.Println("error writing aggregated counts:", err)
+				aggregated.setErr(err)
+			}
+		}
+	}
+}
+
+// Close closes the aggregated report sinks
+func (aggregated *AggregatedReport) Close() {
+	for _, sink := range aggregated.sinks {
+		if err := sink.Close(); err != nil {
+			log.Println("error closing aggregated report:", err)
+			aggregated.setErr(err)
+		}
+	}
+	aggregated.sinks = nil
+}
@@ -0,0 +1,480 @@
+package viewership
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	benchMsos        = 10
+	benchFilesPerMso = 4
+	benchRowsPerFile = 2000
+)
+
+// writeSyntheticFiles writes msos x filesPerMso files, each sorted by ts, into dir:
+// MSO name -> the MSO's files
+func writeSyntheticFiles(tb testing.TB, dir string, msos, filesPerMso, rows int) map[string][]string {
+	random := rand.New(rand.NewSource(1))
+	start := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	fileNames := make(map[string][]string)
+	for m := 0; m < msos; m++ {
+		mso := fmt.Sprintf("mso%02d", m)
+		for f := 0; f < filesPerMso; f++ {
+			entries := make(ReportEntryList, rows)
+			for i := range entries {
+				hh := strconv.Itoa(random.Intn(1000))
+				entries[i] = ReportEntry{
+					HHID:          hh,
+					DeviceID:      hh + "-1",
+					Event:         "watch",
+					Timestamp:     start.Add(time.Duration(random.Intn(24*3600)) * time.Second),
+					ProgramID:     "100",
+					ProgramName:   "Show",
+					ChannelNumber: 1 + random.Intn(100),
+					HasChannel:    true,
+					ChannelName:   "CH",
+					Zipcode:       "79081",
+					Country:       "USA",
+				}
+			}
+			sort.Sort(entries)
+
+			fileName := filepath.Join(dir, fmt.Sprintf("%s_%d.csv", mso, f))
+			if !WriteCSV(fileName, append([][]string{Columns}, entries.Convert(false, false)...), true) {
+				tb.Fatalf("could not write %s", fileName)
+			}
+			fileNames[mso] = append(fileNames[mso], fileName)
+		}
+	}
+	return fileNames
+}
+
+// linearFilesPack is the previous FilesPack: each entry scans the next timestamps of all the files, O(k) per entry
+type linearFilesPack struct {
+	msos  []string
+	files map[string][]*FileStruct
+}
+
+func newLinearFilesPack(fileNames map[string][]string, options Options) *linearFilesPack {
+	filePack := &linearFilesPack{files: make(map[string][]*FileStruct)}
+	for mso, files := range fileNames {
+		filePack.msos = append(filePack.msos, mso)
+		for _, fileName := range files {
+			fileStruct := NewFileStruct(fileName, mso, options)
+			if fileStruct.Init() {
+				filePack.files[mso] = append(filePack.files[mso], fileStruct)
+			}
+		}
+	}
+	sort.Strings(filePack.msos)
+	return filePack
+}
+
+func (filePack *linearFilesPack) NextMinItem() (ReportEntry, string) {
+	var minTs time.Time
+	minMso := ""
+	minIndex := -1
+
+	for _, mso := range filePack.msos {
+		for i, file := range filePack.files[mso] {
+			if file.Ended() {
+				continue
+			}
+			ts, err := file.PeekNextItemTimestamp()
+			if err != nil {
+				continue
+			}
+			if minMso == "" || ts.Before(minTs) {
+				minTs = ts
+				minMso = mso
+				minIndex = i
+			}
+		}
+	}
+
+	if minMso == "" {
+		return noValueEntry, ""
+	}
+	return filePack.files[minMso][minIndex].PopNextItem(), minMso
+}
+
+// countingRejecter counts the files read and the rejected rows
+type countingRejecter struct {
+	tracked  []string
+	rejected int
+}
+
+func (rejecter *countingRejecter) Track(fileName string) {
+	rejecter.tracked = append(rejecter.tracked, fileName)
+}
+
+func (rejecter *countingRejecter) Reject(fileName string, line int, reason error, record []string) {
+	rejecter.rejected++
+}
+
+// TestReadNextBlockRejected checks a block of the rejected rows does not end the file
+func TestReadNextBlockRejected(t *testing.T) {
+	good := []string{"1", "1-1", "watch", "2016-06-01 00:00:01", "100", "Show", "1", "CH", "79081", "USA"}
+	bad := []string{"1", "1-1", "watch", "not a ts", "100", "Show", "1", "CH", "79081", "USA"}
+
+	content := [][]string{Columns, good}
+	for i := 0; i < 2*maxLines; i++ {
+		content = append(content, bad)
+	}
+	content = append(content, good)
+
+	fileName := filepath.Join(t.TempDir(), "htc.csv")
+	if !WriteCSV(fileName, content, true) {
+		t.Fatalf("could not write %s", fileName)
+	}
+
+	rejecter := &countingRejecter{}
+	pack := NewFilesPack(map[string][]string{"htc": {fileName}}, Options{Rejecter: rejecter})
+
+	count := 0
+	for entry, _ := pack.NextMinItem(); !entry.IsZero(); entry, _ = pack.NextMinItem() {
+		count++
+	}
+
+	if count != 2 {
+		t.Errorf("read %d entries, expected 2", count)
+	}
+	if rejecter.rejected != 2*maxLines {
+		t.Errorf("rejected %d rows, expected %d", rejecter.rejected, 2*maxLines)
+	}
+	if len(rejecter.tracked) != 1 || rejecter.tracked[0] != fileName {
+		t.Errorf("tracked %v, expected %s", rejecter.tracked, fileName)
+	}
+}
+
+// TestFilesPackGzip checks the sorted gzipped files merge the same as their csv
+func TestFilesPackGzip(t *testing.T) {
+	dir := t.TempDir()
+	fileNames := writeSyntheticFiles(t, dir, 2, 2, 300)
+
+	gzipped := make(map[string][]string)
+	for mso, files := range fileNames {
+		for _, fileName := range files {
+			content, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := os.Create(fileName + ".gz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			zipWriter := gzip.NewWriter(out)
+			zipWriter.Write(content)
+			zipWriter.Close()
+			out.Close()
+
+			gzipped[mso] = append(gzipped[mso], fileName+".gz")
+		}
+	}
+
+	pack := NewFilesPack(fileNames, Options{})
+	zipPack := NewFilesPack(gzipped, Options{})
+
+	count := 0
+	for {
+		entry, mso := pack.NextMinItem()
+		zipEntry, zipMso := zipPack.NextMinItem()
+		if entry != zipEntry || mso != zipMso {
+			t.Fatalf("entry %d: %v %s from gzip, expected %v %s", count, zipEntry, zipMso, entry, mso)
+		}
+		if entry.IsZero() {
+			break
+		}
+		count++
+	}
+
+	if count != 2*2*300 {
+		t.Errorf("merged %d entries, expected %d", count, 2*2*300)
+	}
+	if err := zipPack.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNextMinItemOrder checks the heap merge gives all the entries in the ts order, as the linear scan
+func TestNextMinItemOrder(t *testing.T) {
+	fileNames := writeSyntheticFiles(t, t.TempDir(), 3, 2, 200)
+
+	pack := NewFilesPack(fileNames, Options{})
+	linear := newLinearFilesPack(fileNames, Options{})
+
+	count := 0
+	var lastTs time.Time
+	for {
+		entry, _ := pack.NextMinItem()
+		expected, _ := linear.NextMinItem()
+		if entry.IsZero() || expected.IsZero() {
+			if !entry.IsZero() || !expected.IsZero() {
+				t.Fatalf("merges ended at different entries after %d", count)
+			}
+			break
+		}
+
+		if entry.Timestamp.Before(lastTs) {
+			t.Fatalf("entry %d out of order: %v before %v", count, entry.Timestamp, lastTs)
+		}
+		if !entry.Timestamp.Equal(expected.Timestamp) {
+			t.Fatalf("entry %d: ts %v, linear scan %v", count, entry.Timestamp, expected.Timestamp)
+		}
+		lastTs = entry.Timestamp
+		count++
+	}
+
+	if count != 3*2*200 {
+		t.Errorf("merged %d entries, expected %d", count, 3*2*200)
+	}
+}
+
+// BenchmarkNextMinItem merges 10 MSOs x 4 sorted files through the heap and through the linear scan
+func BenchmarkNextMinItem(b *testing.B) {
+	fileNames := writeSyntheticFiles(b, b.TempDir(), benchMsos, benchFilesPerMso, benchRowsPerFile)
+
+	b.Run("heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			pack := NewFilesPack(fileNames, Options{})
+			b.StartTimer()
+
+			for entry, _ := pack.NextMinItem(); !entry.IsZero(); entry, _ = pack.NextMinItem() {
+			}
+		}
+	})
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			pack := newLinearFilesPack(fileNames, Options{})
+			b.StartTimer()
+
+			for entry, _ := pack.NextMinItem(); !entry.IsZero(); entry, _ = pack.NextMinItem() {
+			}
+		}
+	})
+}
+
+// memorySink keeps the events and the counts written into it
+type memorySink struct {
+	events     []Event
+	reportDate string
+	counts     map[string]MsoCounts
+	closed     bool
+}
+
+func (sink *memorySink) Write(events []Event) error {
+	sink.events = append(sink.events, events...)
+	return nil
+}
+
+func (sink *memorySink) WriteCounts(reportDate string, counts map[string]MsoCounts) error {
+	sink.reportDate = reportDate
+	sink.counts = counts
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	sink.closed = true
+	return nil
+}
+
+// testEntry returns the household's device watching the channel at ts: 2016-06-01 10:00:00
+func testEntry(tb testing.TB, hh, device, ts string, channel int) ReportEntry {
+	tb.Helper()
+	timestamp, err := time.Parse(TimestampFormat, ts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ReportEntry{
+		HHID:          hh,
+		DeviceID:      device,
+		Event:         "watch",
+		Timestamp:     timestamp,
+		ProgramID:     "100",
+		ProgramName:   "Show",
+		ChannelNumber: channel,
+		HasChannel:    true,
+		ChannelName:   "CH",
+		Zipcode:       "79081",
+		Country:       "USA",
+	}
+}
+
+// writeEntriesFile writes the entries, in the given order, into the csv file with the header
+func writeEntriesFile(tb testing.TB, fileName string, entries ...ReportEntry) string {
+	tb.Helper()
+	if !WriteCSV(fileName, append([][]string{Columns}, ReportEntryList(entries).Convert(false, false)...), true) {
+		tb.Fatalf("could not write %s", fileName)
+	}
+	return fileName
+}
+
+// eventTimes returns the MSO and ts of each event
+func eventTimes(events []Event) []string {
+	times := []string{}
+	for _, event := range events {
+		times = append(times, event.Mso+" "+event.Timestamp.Format(TimestampFormat))
+	}
+	return times
+}
+
+// TestProcessFiles checks only the events of the report day are written, in the ts order across the MSO's files,
+// and counted per MSO, the MSO's without events included
+func TestProcessFiles(t *testing.T) {
+	dir := t.TempDir()
+	fileNames := map[string][]string{
+		"htc": {
+			writeEntriesFile(t, filepath.Join(dir, "htc_20160601.csv"),
+				testEntry(t, "1", "1-1", "2016-05-31 23:59:59", 4),
+				testEntry(t, "1", "1-1", "2016-06-01 00:00:00", 4),
+				testEntry(t, "2", "2-1", "2016-06-01 12:00:00", 5)),
+			writeEntriesFile(t, filepath.Join(dir, "htc_20160602.csv"),
+				testEntry(t, "1", "1-2", "2016-06-01 23:59:59", 4),
+				testEntry(t, "1", "1-1", "2016-06-02 00:00:00", 4)),
+		},
+		"hc": {
+			writeEntriesFile(t, filepath.Join(dir, "hc_20160601.csv"),
+				testEntry(t, "3", "3-1", "2016-06-01 10:00:00", 4),
+				testEntry(t, "3", "3-2", "2016-06-01 11:00:00", 4)),
+		},
+	}
+
+	sink := &memorySink{}
+	report := NewAggregatedReportSink(sink, []string{"htc", "hc", "armstrong"})
+	report.ProcessFiles(NewFilesPack(fileNames, Options{}), "20160601")
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"htc 2016-06-01 00:00:00",
+		"hc 2016-06-01 10:00:00",
+		"hc 2016-06-01 11:00:00",
+		"htc 2016-06-01 12:00:00",
+		"htc 2016-06-01 23:59:59",
+	}
+	if times := eventTimes(sink.events); !reflect.DeepEqual(times, expected) {
+		t.Errorf("written %v, expected %v", times, expected)
+	}
+
+	expectedCounts := map[string]MsoCounts{
+		"htc":       {Households: 2, Devices: 3, Events: 3, DevicesPerHousehold: map[int]int{1: 1, 2: 1}},
+		"hc":        {Households: 1, Devices: 2, Events: 2, DevicesPerHousehold: map[int]int{2: 1}},
+		"armstrong": {DevicesPerHousehold: map[int]int{}},
+	}
+	if !reflect.DeepEqual(sink.counts, expectedCounts) {
+		t.Errorf("counts %v, expected %v", sink.counts, expectedCounts)
+	}
+	if hhCounts := report.HHCounts(); !reflect.DeepEqual(hhCounts, map[string]int{"htc": 2, "hc": 1, "armstrong": 0}) {
+		t.Errorf("hh counts %v", hhCounts)
+	}
+	if sink.reportDate != "2016-06-01" || report.ReportDate() != "2016-06-01" {
+		t.Errorf("report date %s, %s, expected 2016-06-01", sink.reportDate, report.ReportDate())
+	}
+	if !sink.closed {
+		t.Error("sink not closed")
+	}
+}
+
+// TestProcessFilesDedup checks the events re-sent in the next day's file are dropped once per MSO,
+// and the other MSO's same event is kept
+func TestProcessFilesDedup(t *testing.T) {
+	dir := t.TempDir()
+	resent := testEntry(t, "1", "1-1", "2016-06-01 23:00:00", 4)
+	fileNames := map[string][]string{
+		"htc": {
+			writeEntriesFile(t, filepath.Join(dir, "htc_20160601.csv"),
+				testEntry(t, "1", "1-1", "2016-06-01 10:00:00", 4),
+				resent),
+			writeEntriesFile(t, filepath.Join(dir, "htc_20160602.csv"),
+				resent,
+				// the same but the channel
+				testEntry(t, "1", "1-1", "2016-06-01 23:00:00", 5),
+				testEntry(t, "1", "1-1", "2016-06-02 01:00:00", 4)),
+		},
+		"hc": {
+			writeEntriesFile(t, filepath.Join(dir, "hc_20160602.csv"), resent),
+		},
+	}
+
+	for _, dedup := range []bool{false, true} {
+		sink := &memorySink{}
+		report := NewAggregatedReportSink(sink, []string{"htc", "hc"})
+		report.SetDedup(dedup)
+		report.ProcessFiles(NewFilesPack(fileNames, Options{}), "20160601")
+
+		expected := []string{
+			"htc 2016-06-01 10:00:00",
+			"hc 2016-06-01 23:00:00",
+			"htc 2016-06-01 23:00:00",
+			"htc 2016-06-01 23:00:00",
+		}
+		expectedDuplicates := map[string]int{"htc": 0, "hc": 0}
+		if dedup {
+			expectedDuplicates["htc"] = 1
+		} else {
+			expected = append(expected, "htc 2016-06-01 23:00:00")
+		}
+
+		if times := eventTimes(sink.events); !reflect.DeepEqual(times, expected) {
+			t.Errorf("dedup %v: written %v, expected %v", dedup, times, expected)
+		}
+		if duplicates := report.Duplicates(); !reflect.DeepEqual(duplicates, expectedDuplicates) {
+			t.Errorf("dedup %v: duplicates %v, expected %v", dedup, duplicates, expectedDuplicates)
+		}
+	}
+}
+
+// TestProcessFilesDedupRatings checks the duplicates are dropped before the devices' tuning:
+// the re-sent tuning to the earlier channel does not take the device back to it
+func TestProcessFilesDedupRatings(t *testing.T) {
+	dir := t.TempDir()
+	tune := func(ts string, channel int) ReportEntry {
+		entry := testEntry(t, "1", "1-1", ts, channel)
+		entry.ChannelName = "CH" + strconv.Itoa(channel)
+		return entry
+	}
+	fileNames := map[string][]string{
+		"htc": {
+			writeEntriesFile(t, filepath.Join(dir, "htc_20160601.csv"),
+				tune("2016-06-01 10:00:00", 4),
+				tune("2016-06-01 10:00:00", 5)),
+			// re-sent in the next day's file
+			writeEntriesFile(t, filepath.Join(dir, "htc_20160602.csv"),
+				tune("2016-06-01 10:00:00", 4)),
+		},
+	}
+
+	ratings, err := NewQuarterHourRatings("20160601", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := NewAggregatedReportSink(nil, []string{"htc"})
+	report.SetDedup(true)
+	report.SetRatings(ratings, 30*time.Minute)
+	report.ProcessFiles(NewFilesPack(fileNames, Options{}), "20160601")
+
+	list := ratings.Ratings()
+	if len(list) != 2 {
+		t.Fatalf("rated %d slots, expected 2: %v", len(list), list)
+	}
+	for _, rating := range list {
+		if rating.ChannelName != "CH5" {
+			t.Errorf("rated %v, expected the device tuned to CH5", rating)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package viewership
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetEntry is the Parquet schema of ReportEntry
+type parquetEntry struct {
+	HHID          string `parquet:"name=hh_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	DeviceID      string `parquet:"name=device_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Event         string `parquet:"name=event, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Timestamp     int64  `parquet:"name=ts, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	ProgramID     string `parquet:"name=pg_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ProgramName   string `parquet:"name=pg_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ChannelNumber *int32 `parquet:"name=ch_num, type=INT32, repetitiontype=OPTIONAL"`
+	ChannelName   string `parquet:"name=ch_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Zipcode       string `parquet:"name=zipcode, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Country       string `parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// parquetCodecs are the supported compression codecs
+var parquetCodecs = map[string]parquet.CompressionCodec{
+	"":       parquet.CompressionCodec_SNAPPY,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+	"lz4":    parquet.CompressionCodec_LZ4,
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+}
+
+// IsParquetCompression returns true for the supported compression codec
+func IsParquetCompression(compression string) bool {
+	_, ok := parquetCodecs[strings.ToLower(compression)]
+	return ok
+}
+
+// ParquetSink writes the events into the Parquet file: ts as timestamp, ch_num as optional int
+type ParquetSink struct {
+	file   *os.File
+	writer *writer.ParquetWriter
+}
+
+// NewParquetSink creates the Parquet file with the row group size and the compression of the options
+func NewParquetSink(fileName string, options SinkOptions) (*ParquetSink, error) {
+	codec, ok := parquetCodecs[strings.ToLower(options.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown parquet compression: %s", options.Compression)
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	parquetWriter, err := writer.NewParquetWriterFromWriter(file, new(parquetEntry), 1)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	parquetWriter.CompressionType = codec
+	if options.RowGroupSize > 0 {
+		parquetWriter.RowGroupSize = options.RowGroupSize
+	}
+
+	return &ParquetSink{file: file, writer: parquetWriter}, nil
+}
+
+// Write adds the entries of the events to the current row group
+func (sink *ParquetSink) Write(events []Event) error {
+	for _, entry := range events {
+		row := parquetEntry{
+			HHID:        entry.HHID,
+			DeviceID:    entry.DeviceID,
+			Event:       entry.Event,
+			Timestamp:   entry.Timestamp.UnixNano() / 1e6,
+			ProgramID:   entry.ProgramID,
+			ProgramName: entry.ProgramName,
+			ChannelName: entry.ChannelName,
+			Zipcode:     entry.Zipcode,
+			Country:     entry.Country,
+		}
+		if entry.HasChannel {
+			chNum := int32(entry.ChannelNumber)
+			row.ChannelNumber = &chNum
+		}
+
+		if err := sink.writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the last row group and the footer, and closes the file
+func (sink *ParquetSink) Close() error {
+	err := sink.writer.WriteStop()
+	if closeErr := sink.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
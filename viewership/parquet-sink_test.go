@@ -0,0 +1,111 @@
+package viewership
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// openParquetFile opens the Parquet file for reading into the rows of obj, or with its own schema if nil
+func openParquetFile(t *testing.T, fileName string, obj interface{}) *reader.ParquetReader {
+	t.Helper()
+	file, err := local.NewLocalFileReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	parquetReader, err := reader.NewParquetReader(file, obj, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(parquetReader.ReadStop)
+	return parquetReader
+}
+
+// TestParquetSinkRoundTrip checks the written file reads back with the schema of the report columns
+// and all the events: ts in milliseconds, ch_num null if missing
+func TestParquetSinkRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "aggregated_viewership_20160601.parquet")
+	noChannel := testEntry(t, "2", "2-1", "2016-06-01 11:00:00", 0)
+	noChannel.HasChannel = false
+	events := []Event{
+		{Mso: "htc", ReportEntry: testEntry(t, "1", "1-1", "2016-06-01 10:00:00", 4)},
+		{Mso: "htc", ReportEntry: noChannel},
+		{Mso: "hc", ReportEntry: testEntry(t, "3", "3-1", "2016-06-01 12:00:00", 0)},
+	}
+
+	sink, err := NewParquetSink(fileName, SinkOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(events[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(events[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file's own schema, the reader renames the footer columns to the Go names
+	schemaReader := openParquetFile(t, fileName, nil)
+	// the rows
+	parquetReader := openParquetFile(t, fileName, new(parquetEntry))
+
+	expectedSchema := []struct {
+		name, kind, converted, repetition string
+	}{
+		{"hh_id", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"device_id", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"event", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"ts", "INT64", "TIMESTAMP_MILLIS", "REQUIRED"},
+		{"pg_id", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"pg_name", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"ch_num", "INT32", "", "OPTIONAL"},
+		{"ch_name", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"zipcode", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+		{"country", "BYTE_ARRAY", "UTF8", "REQUIRED"},
+	}
+	// the first element is the root
+	schema := schemaReader.Footer.Schema[1:]
+	if len(schema) != len(expectedSchema) {
+		t.Fatalf("%d columns, expected %d", len(schema), len(expectedSchema))
+	}
+	for i, element := range schema {
+		expected := expectedSchema[i]
+		name := schemaReader.SchemaHandler.Infos[i+1].ExName
+		converted := ""
+		if element.IsSetConvertedType() {
+			converted = element.GetConvertedType().String()
+		}
+		if name != expected.name || element.GetType().String() != expected.kind ||
+			converted != expected.converted || element.GetRepetitionType().String() != expected.repetition {
+			t.Errorf("column %d: %s %s %s %s, expected %v", i, name, element.GetType(), converted, element.GetRepetitionType(), expected)
+		}
+	}
+
+	if rows := parquetReader.GetNumRows(); rows != int64(len(events)) {
+		t.Fatalf("%d rows, expected %d", rows, len(events))
+	}
+	rows := make([]parquetEntry, len(events))
+	if err := parquetReader.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		entry := events[i].ReportEntry
+		if row.HHID != entry.HHID || row.DeviceID != entry.DeviceID || row.ProgramName != entry.ProgramName ||
+			row.Timestamp != entry.Timestamp.UnixNano()/1e6 {
+			t.Errorf("row %d: %+v, expected %+v", i, row, entry)
+		}
+		switch {
+		case !entry.HasChannel && row.ChannelNumber != nil:
+			t.Errorf("row %d: ch_num %d, expected null", i, *row.ChannelNumber)
+		case entry.HasChannel && (row.ChannelNumber == nil || int(*row.ChannelNumber) != entry.ChannelNumber):
+			t.Errorf("row %d: ch_num %v, expected %d", i, row.ChannelNumber, entry.ChannelNumber)
+		}
+	}
+}
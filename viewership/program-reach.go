@@ -0,0 +1,75 @@
+package viewership
+
+import (
+	"sort"
+)
+
+// ProgramReach is the number of the distinct households and devices viewing the MSO's program
+type ProgramReach struct {
+	Mso         string
+	ProgramID   string
+	ProgramName string
+	Households  int
+	Devices     int
+}
+
+// programViewers are the distinct households and devices of a single program
+type programViewers struct {
+	programID   string
+	programName string
+	hhs         map[string]bool
+	devices     map[string]bool
+}
+
+// programsReach collects the viewers per MSO per program: pg_id and pg_name
+type programsReach map[string]map[string]*programViewers
+
+func (reach programsReach) add(mso string, entry ReportEntry) {
+	programs, ok := reach[mso]
+	if !ok {
+		programs = make(map[string]*programViewers)
+		reach[mso] = programs
+	}
+
+	key := entry.ProgramID + "\x00" + entry.ProgramName
+	viewers, ok := programs[key]
+	if !ok {
+		viewers = &programViewers{
+			programID:   entry.ProgramID,
+			programName: entry.ProgramName,
+			hhs:         make(map[string]bool),
+			devices:     make(map[string]bool),
+		}
+		programs[key] = viewers
+	}
+
+	viewers.hhs[entry.HHID] = true
+	viewers.devices[entry.DeviceID] = true
+}
+
+// list returns the reach ordered by MSO, pg_id and pg_name
+func (reach programsReach) list() []ProgramReach {
+	list := []ProgramReach{}
+	for mso, programs := range reach {
+		for _, viewers := range programs {
+			list = append(list, ProgramReach{
+				Mso:         mso,
+				ProgramID:   viewers.programID,
+				ProgramName: viewers.programName,
+				Households:  len(viewers.hhs),
+				Devices:     len(viewers.devices),
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Mso != list[j].Mso {
+			return list[i].Mso < list[j].Mso
+		}
+		if list[i].ProgramID != list[j].ProgramID {
+			return list[i].ProgramID < list[j].ProgramID
+		}
+		return list[i].ProgramName < list[j].ProgramName
+	})
+	return list
+}
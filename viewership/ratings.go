@@ -0,0 +1,136 @@
+package viewership
+
+import (
+	"sort"
+	"time"
+)
+
+// QuarterHour is the length of the ratings slot
+const QuarterHour = 15 * time.Minute
+
+// ChannelRating is the number of the MSO's households tuned to the channel in the quarter-hour slot
+type ChannelRating struct {
+	Slot        time.Time
+	Mso         string
+	ChannelName string
+	Households  int
+}
+
+// ratingKey is the household tuned to the MSO's channel
+type ratingKey struct {
+	mso     string
+	channel string
+	hh      string
+}
+
+// tunedInterval is the time a device is tuned in within the slot
+type tunedInterval struct {
+	start time.Time
+	end   time.Time
+}
+
+// QuarterHourRatings counts per quarter-hour slot of the report day, per MSO and channel,
+// the households tuned in for at least minTuned of the slot
+// The tuning comes as the sessions of the devices, the household is tuned in while any of its devices is,
+// so the devices tuned in at the same time count once
+type QuarterHourRatings struct {
+	dayStart time.Time
+	dayEnd   time.Time
+	minTuned time.Duration
+	slots    []map[ratingKey][]tunedInterval
+}
+
+// NewQuarterHourRatings creates the ratings of the report day: 20160601
+func NewQuarterHourRatings(reportDay string, minTuned time.Duration) (*QuarterHourRatings, error) {
+	dayStart, dayEnd, err := ParseReportDay(reportDay)
+	if err != nil {
+		return nil, err
+	}
+
+	ratings := &QuarterHourRatings{
+		dayStart: dayStart,
+		dayEnd:   dayEnd,
+		minTuned: minTuned,
+		slots:    make([]map[ratingKey][]tunedInterval, int(dayEnd.Sub(dayStart)/QuarterHour)),
+	}
+	for i := range ratings.slots {
+		ratings.slots[i] = make(map[ratingKey][]tunedInterval)
+	}
+	return ratings, nil
+}
+
+// AddSession adds the session's tuning time within the report day to the slots it spans
+func (ratings *QuarterHourRatings) AddSession(session Session) {
+	start, end := session.Start, session.End
+	if start.Before(ratings.dayStart) {
+		start = ratings.dayStart
+	}
+	if end.After(ratings.dayEnd) {
+		end = ratings.dayEnd
+	}
+
+	key := ratingKey{session.Mso, session.ChannelName, session.HHID}
+	for start.Before(end) {
+		slot := int(start.Sub(ratings.dayStart) / QuarterHour)
+		slotEnd := ratings.dayStart.Add(time.Duration(slot+1) * QuarterHour)
+		if slotEnd.After(end) {
+			slotEnd = end
+		}
+
+		ratings.slots[slot][key] = append(ratings.slots[slot][key], tunedInterval{start, slotEnd})
+		start = slotEnd
+	}
+}
+
+// Ratings returns the households count per slot, MSO and channel, ordered by slot, MSO and channel,
+// only the channels having households tuned in
+func (ratings *QuarterHourRatings) Ratings() []ChannelRating {
+	list := []ChannelRating{}
+	for i, slot := range ratings.slots {
+		counts := make(map[ratingKey]int)
+		for key, intervals := range slot {
+			if tunedTime(intervals) >= ratings.minTuned {
+				counts[ratingKey{mso: key.mso, channel: key.channel}]++
+			}
+		}
+
+		slotStart := ratings.dayStart.Add(time.Duration(i) * QuarterHour)
+		first := len(list)
+		for key, count := range counts {
+			list = append(list, ChannelRating{
+				Slot:        slotStart,
+				Mso:         key.mso,
+				ChannelName: key.channel,
+				Households:  count,
+			})
+		}
+
+		slotList := list[first:]
+		sort.Slice(slotList, func(i, j int) bool {
+			if slotList[i].Mso != slotList[j].Mso {
+				return slotList[i].Mso < slotList[j].Mso
+			}
+			return slotList[i].ChannelName < slotList[j].ChannelName
+		})
+	}
+	return list
+}
+
+// tunedTime returns the length of the union of the intervals
+func tunedTime(intervals []tunedInterval) time.Duration {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Before(intervals[j].start)
+	})
+
+	var tuned time.Duration
+	var start, end time.Time
+	for i, interval := range intervals {
+		if i == 0 || interval.start.After(end) {
+			tuned += end.Sub(start)
+			start, end = interval.start, interval.end
+		} else if interval.end.After(end) {
+			end = interval.end
+		}
+	}
+	return tuned + end.Sub(start)
+}
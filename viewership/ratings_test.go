@@ -0,0 +1,53 @@
+package viewership
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRatingsOverlappingDevices checks the household's devices tuned in at the same time count once
+func TestRatingsOverlappingDevices(t *testing.T) {
+	ratings, err := NewQuarterHourRatings("20160601", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slot := time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC)
+	for _, device := range []string{"1-1", "1-2"} {
+		ratings.AddSession(Session{
+			Mso:         "htc",
+			HHID:        "1",
+			DeviceID:    device,
+			ChannelName: "CH",
+			Start:       slot,
+			End:         slot.Add(3 * time.Minute),
+		})
+	}
+
+	if list := ratings.Ratings(); len(list) != 0 {
+		t.Errorf("household tuned in 3 minutes rated: %v", list)
+	}
+}
+
+// TestRatingsSteadyTuning checks the device tuned in once stays tuned in up to the idle timeout
+func TestRatingsSteadyTuning(t *testing.T) {
+	ratings, err := NewQuarterHourRatings("20160601", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := NewSessionBuilder(30*time.Minute, 0, ratings.AddSession)
+	builder.Add("htc", tuneEntry("1-1", time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC), 4))
+	builder.Flush()
+
+	list := ratings.Ratings()
+	if len(list) != 2 {
+		t.Fatalf("rated %d slots, expected 2: %v", len(list), list)
+	}
+	for i, rating := range list {
+		slot := time.Date(2016, 6, 1, 10, 15*i, 0, 0, time.UTC)
+		if !rating.Slot.Equal(slot) || rating.Households != 1 {
+			t.Errorf("rating %d: %v, expected 1 household at %v", i, rating, slot)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package viewership
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"sort"
+)
+
+// HouseholdSet is the set of the distinct households, kept per MSO per day
+// to count the reach over several days without reading the raw files again
+type HouseholdSet map[string]bool
+
+// Add adds the households of the other set
+func (set HouseholdSet) Add(other HouseholdSet) {
+	for hh := range other {
+		set[hh] = true
+	}
+}
+
+// List returns the households, sorted
+func (set HouseholdSet) List() []string {
+	list := make([]string, 0, len(set))
+	for hh := range set {
+		list = append(list, hh)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// WriteHouseholdSet writes the set as csv: hh_id header, one household per line
+func WriteHouseholdSet(w io.Writer, set HouseholdSet) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"hh_id"})
+	for _, hh := range set.List() {
+		writer.Write([]string{hh})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ReadHouseholdSet reads the set written by WriteHouseholdSet
+func ReadHouseholdSet(r io.Reader) (HouseholdSet, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) != 1 || normalizeColumn(header[0]) != "hh_id" {
+		return nil, errors.New("not a household set, expected hh_id header")
+	}
+
+	set := make(HouseholdSet)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return set, nil
+		} else if err != nil {
+			return nil, err
+		}
+		set[record[0]] = true
+	}
+}
+
+// RollingReach returns for each day in days the number of the distinct households over
+// the window of the days ending with it: days[i-window+1]..days[i]
+// The days are consecutive, the days without a set count as no households
+func RollingReach(days []string, sets map[string]HouseholdSet, window int) []int {
+	reach := make([]int, len(days))
+
+	// the number of the days in the window each household is seen on
+	seen := make(map[string]int)
+	for i, day := range days {
+		for hh := range sets[day] {
+			seen[hh]++
+		}
+
+		if i >= window {
+			for hh := range sets[days[i-window]] {
+				if seen[hh]--; seen[hh] == 0 {
+					delete(seen, hh)
+				}
+			}
+		}
+
+		reach[i] = len(seen)
+	}
+	return reach
+}
+
+// HouseholdSets returns the distinct households per MSO for the processed report day
+func (aggregated *AggregatedReport) HouseholdSets() map[string]HouseholdSet {
+	sets := make(map[string]HouseholdSet)
+	for mso, hhs := range aggregated.hhCounts {
+		set := make(HouseholdSet, len(hhs))
+		for hh := range hhs {
+			set[hh] = true
+		}
+		sets[mso] = set
+	}
+	return sets
+}
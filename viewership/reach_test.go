@@ -0,0 +1,55 @@
+package viewership
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestRollingReach checks the households are counted once over the window, and leave it with their last day
+func TestRollingReach(t *testing.T) {
+	days := []string{"20160601", "20160602", "20160603", "20160604", "20160605"}
+	sets := map[string]HouseholdSet{
+		"20160601": {"1": true, "2": true},
+		"20160602": {"2": true},
+		// 20160603 missing
+		"20160604": {"3": true},
+		"20160605": {"2": true, "3": true},
+	}
+
+	tests := []struct {
+		window int
+		reach  []int
+	}{
+		{1, []int{2, 1, 0, 1, 2}},
+		{2, []int{2, 2, 1, 1, 2}},
+		{3, []int{2, 2, 2, 2, 2}},
+		{28, []int{2, 2, 2, 3, 3}},
+	}
+	for _, test := range tests {
+		if reach := RollingReach(days, sets, test.window); !reflect.DeepEqual(reach, test.reach) {
+			t.Errorf("window %d: %v, expected %v", test.window, reach, test.reach)
+		}
+	}
+}
+
+// TestHouseholdSetRoundTrip checks the set reads back as written, and the other csv is not taken for a set
+func TestHouseholdSetRoundTrip(t *testing.T) {
+	set := HouseholdSet{"112961": true, "2": true, "hh,with comma": true}
+
+	var buffer bytes.Buffer
+	if err := WriteHouseholdSet(&buffer, set); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadHouseholdSet(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, set) {
+		t.Errorf("read %v, expected %v", read, set)
+	}
+
+	if _, err := ReadHouseholdSet(bytes.NewBufferString("date,provider_code,hh_id_count\n")); err == nil {
+		t.Error("hh_count read as a household set")
+	}
+}
@@ -0,0 +1,165 @@
+package viewership
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampFormat is the format of ts in the viewership files
+const TimestampFormat = "2006-01-02 15:04:05"
+
+// ReportEntry is a single viewership event
+// hh_id, device_id, event, ts, pg_id, pg_name, ch_num, ch_name, zipcode, country
+// 112961,112961-1,watch,2016-07-02 23:21:58,975540,"Oklahoma News Report",3,KETA,79081,USA
+type ReportEntry struct {
+	HHID        string
+	DeviceID    string
+	Event       string
+	Timestamp   time.Time
+	ProgramID   string
+	ProgramName string
+	// ChannelNumber is set if HasChannel, ch_num 0 is a valid channel
+	ChannelNumber int
+	HasChannel    bool
+	ChannelName   string
+	Zipcode       string
+	Country       string
+}
+
+// ParseReportEntry parses the fields in the report columns order into the entry:
+// ts in TimestampFormat (UTC), ch_num numeric or empty
+func ParseReportEntry(fields []string) (ReportEntry, error) {
+	if len(fields) != len(Columns) {
+		return ReportEntry{}, fmt.Errorf("expected %d fields, got %d", len(Columns), len(fields))
+	}
+
+	ts, err := time.Parse(TimestampFormat, strings.TrimSpace(fields[colTs]))
+	if err != nil {
+		return ReportEntry{}, fmt.Errorf("invalid ts: %s", fields[colTs])
+	}
+
+	channelNumber := 0
+	chNum := strings.TrimSpace(fields[colChNum])
+	if chNum != "" {
+		if channelNumber, err = strconv.Atoi(chNum); err != nil {
+			return ReportEntry{}, fmt.Errorf("invalid ch_num: %s", fields[colChNum])
+		}
+	}
+
+	return ReportEntry{
+		HHID:          fields[colHHID],
+		DeviceID:      fields[colDeviceID],
+		Event:         fields[colEvent],
+		Timestamp:     ts,
+		ProgramID:     fields[colPgID],
+		ProgramName:   fields[colPgName],
+		ChannelNumber: channelNumber,
+		HasChannel:    chNum != "",
+		ChannelName:   fields[colChName],
+		Zipcode:       fields[colZipcode],
+		Country:       fields[colCountry],
+	}, nil
+}
+
+// Format formats the entry into the fields in the report columns order, the reverse of ParseReportEntry
+func (entry ReportEntry) Format() []string {
+	return []string{
+		entry.HHID,
+		entry.DeviceID,
+		entry.Event,
+		entry.Timestamp.Format(TimestampFormat),
+		entry.ProgramID,
+		entry.ProgramName,
+		formatChannelNumber(entry.ChannelNumber, entry.HasChannel),
+		entry.ChannelName,
+		entry.Zipcode,
+		entry.Country,
+	}
+}
+
+// formatChannelNumber formats ch_num, empty if not provided
+func formatChannelNumber(channelNumber int, hasChannel bool) string {
+	if !hasChannel {
+		return ""
+	}
+	return strconv.Itoa(channelNumber)
+}
+
+// dedupKey identifies the event within its timestamp: hh_id, device_id, event, ch_num
+func (entry ReportEntry) dedupKey() string {
+	return strings.Join([]string{entry.HHID, entry.DeviceID, entry.Event,
+		formatChannelNumber(entry.ChannelNumber, entry.HasChannel)}, "\x00")
+}
+
+// IsZero returns true for the empty entry, returned when there are no more entries
+func (entry ReportEntry) IsZero() bool {
+	return entry.Timestamp.IsZero()
+}
+
+// ParseReportDay parses the "20160601" report date into the day's start and the next day's start
+func ParseReportDay(date string) (dayStart, dayEnd time.Time, err error) {
+	dayStart, err = time.Parse("20060102", date)
+	if err != nil {
+		return dayStart, dayEnd, err
+	}
+	return dayStart, dayStart.AddDate(0, 0, 1), nil
+}
+
+// ReportEntryList list of ReportEntry
+type ReportEntryList []ReportEntry
+
+// Convert converts []ReportEntry into [][]string for csv file
+func (report ReportEntryList) Convert(headerOn bool, addQuotes bool) [][]string {
+	bodyAll := [][]string{}
+	quotes := ""
+
+	if headerOn {
+		bodyAll = append(bodyAll, Columns)
+	}
+
+	if addQuotes {
+		quotes = "\""
+	}
+
+	for _, entry := range report {
+		fields := entry.Format()
+		fields[colPgName] = quotes + fields[colPgName] + quotes
+		bodyAll = append(bodyAll, fields)
+	}
+	return bodyAll
+}
+
+// Len returns the length of the list - for Sortable Interface
+func (report ReportEntryList) Len() int {
+	return len(report)
+}
+
+// Less returns if a[i]<a[j] - for Sortable Interface
+func (report ReportEntryList) Less(i, j int) bool {
+	return report[i].Timestamp.Before(report[j].Timestamp)
+}
+
+// Swap swaps elements i and j - for Sortable Interface
+func (report ReportEntryList) Swap(i, j int) {
+	report[i], report[j] = report[j], report[i]
+}
+
+// Filter returns only the entries for given date
+func (report ReportEntryList) Filter(date string) ReportEntryList {
+	var reportForDate ReportEntryList
+
+	dayStart, dayEnd, err := ParseReportDay(date)
+	if err != nil {
+		return reportForDate
+	}
+
+	for _, entry := range report {
+		if !entry.Timestamp.Before(dayStart) && entry.Timestamp.Before(dayEnd) {
+			reportForDate = append(reportForDate, entry)
+		}
+	}
+
+	return reportForDate
+}
@@ -0,0 +1,27 @@
+package viewership
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestReportEntryChannelRoundTrip checks ch_num 0 and the missing ch_num parse and format back as they were
+func TestReportEntryChannelRoundTrip(t *testing.T) {
+	keys := make(map[string]string)
+	for _, chNum := range []string{"0", "", "4"} {
+		fields := []string{"1", "1-1", "watch", "2016-06-01 00:00:01", "100", "Show", chNum, "CH", "79081", "USA"}
+
+		entry, err := ParseReportEntry(fields)
+		if err != nil {
+			t.Fatalf("ch_num %q: %s", chNum, err)
+		}
+		if formatted := entry.Format(); !reflect.DeepEqual(formatted, fields) {
+			t.Errorf("ch_num %q formatted as %v", chNum, formatted)
+		}
+
+		if other, ok := keys[entry.dedupKey()]; ok {
+			t.Errorf("ch_num %q has the same dedup key as %q", chNum, other)
+		}
+		keys[entry.dedupKey()] = chNum
+	}
+}
@@ -0,0 +1,189 @@
+package viewership
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SessionColumns are the columns of the sessions report
+var SessionColumns = []string{"mso", "hh_id", "device_id", "ch_num", "ch_name", "pg_id", "pg_name", "start", "end", "duration"}
+
+// Session is a continuous viewing of a program on a channel by a device
+type Session struct {
+	Mso           string
+	HHID          string
+	DeviceID      string
+	ChannelNumber int
+	HasChannel    bool
+	ChannelName   string
+	ProgramID     string
+	ProgramName   string
+	Start         time.Time
+	End           time.Time
+}
+
+// Duration returns the length of the session
+func (session Session) Duration() time.Duration {
+	return session.End.Sub(session.Start)
+}
+
+// Format formats the session into the fields in the session columns order, the duration in seconds
+func (session Session) Format() []string {
+	return []string{
+		session.Mso,
+		session.HHID,
+		session.DeviceID,
+		formatChannelNumber(session.ChannelNumber, session.HasChannel),
+		session.ChannelName,
+		session.ProgramID,
+		session.ProgramName,
+		session.Start.Format(TimestampFormat),
+		session.End.Format(TimestampFormat),
+		strconv.Itoa(int(session.Duration() / time.Second)),
+	}
+}
+
+// openSession is the session of a device still being built, with its last event
+type openSession struct {
+	Session
+	lastEvent time.Time
+}
+
+// SessionBuilder turns the per-device event sequences of the merged stream into sessions:
+// the session goes on while the device keeps the channel and the program,
+// it ends at the event switching to another channel or program,
+// or the idle timeout after its last event if the device has no events for longer than that:
+// the events are sent on tuning, so the device is taken as still watching until the timeout,
+// and a single event session lasts the idle timeout
+// The sessions longer than the max length are split into max length parts
+type SessionBuilder struct {
+	idleTimeout time.Duration
+	maxLength   time.Duration
+	open        map[string]*openSession
+	emit        func(Session)
+}
+
+// NewSessionBuilder creates the builder passing each completed session to emit
+func NewSessionBuilder(idleTimeout, maxLength time.Duration, emit func(Session)) *SessionBuilder {
+	return &SessionBuilder{
+		idleTimeout: idleTimeout,
+		maxLength:   maxLength,
+		open:        make(map[string]*openSession),
+		emit:        emit,
+	}
+}
+
+// Add adds the MSO's event to the session of its device, the events are expected ordered by ts
+func (builder *SessionBuilder) Add(mso string, entry ReportEntry) {
+	key := mso + "\x00" + entry.DeviceID
+	ts := entry.Timestamp
+
+	session, ok := builder.open[key]
+	if ok {
+		switch {
+		case ts.Sub(session.lastEvent) > builder.idleTimeout:
+			builder.close(key, session.lastEvent.Add(builder.idleTimeout))
+			ok = false
+		case session.ChannelNumber != entry.ChannelNumber || session.HasChannel != entry.HasChannel ||
+			session.ChannelName != entry.ChannelName || session.ProgramID != entry.ProgramID:
+			builder.close(key, ts)
+			ok = false
+		default:
+			session.lastEvent = ts
+		}
+	}
+
+	if !ok {
+		builder.open[key] = &openSession{
+			Session: Session{
+				Mso:           mso,
+				HHID:          entry.HHID,
+				DeviceID:      entry.DeviceID,
+				ChannelNumber: entry.ChannelNumber,
+				HasChannel:    entry.HasChannel,
+				ChannelName:   entry.ChannelName,
+				ProgramID:     entry.ProgramID,
+				ProgramName:   entry.ProgramName,
+				Start:         ts,
+			},
+			lastEvent: ts,
+		}
+	}
+}
+
+// close completes the device's session at end, split into the max length parts
+func (builder *SessionBuilder) close(key string, end time.Time) {
+	session := builder.open[key].Session
+	delete(builder.open, key)
+
+	for builder.maxLength > 0 && end.Sub(session.Start) > builder.maxLength {
+		part := session
+		part.End = session.Start.Add(builder.maxLength)
+		builder.emit(part)
+		session.Start = part.End
+	}
+
+	session.End = end
+	builder.emit(session)
+}
+
+// Flush completes all the open sessions at the idle timeout after their last events, in the order of their start
+func (builder *SessionBuilder) Flush() {
+	keys := make([]string, 0, len(builder.open))
+	for key := range builder.open {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := builder.open[keys[i]], builder.open[keys[j]]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		builder.close(key, builder.open[key].lastEvent.Add(builder.idleTimeout))
+	}
+}
+
+// ----------------------------------------------------------------------
+
+// SessionsReport writes the sessions into the file, buffered
+type SessionsReport struct {
+	filename string
+	buffer   [][]string
+}
+
+// NewSessionsReport creates the sessions report file with the header
+func NewSessionsReport(fileName string) (*SessionsReport, error) {
+	if !WriteCSV(fileName, [][]string{SessionColumns}, true) {
+		return nil, errors.New("Could not create sessions file:" + fileName)
+	}
+
+	return &SessionsReport{filename: fileName}, nil
+}
+
+// WriteSession writes the session to the buffer, if buffer has NN values, flush to the disk
+func (report *SessionsReport) WriteSession(session Session) {
+	report.buffer = append(report.buffer, session.Format())
+
+	if len(report.buffer) > MaxLinesAggregated {
+		report.writeBuffer()
+	}
+}
+
+func (report *SessionsReport) writeBuffer() bool {
+	ok := WriteCSV(report.filename, report.buffer, false)
+	report.buffer = report.buffer[:0]
+	return ok
+}
+
+// Close flushes the buffer to the file
+func (report *SessionsReport) Close() error {
+	if !report.writeBuffer() {
+		return errors.New("Could not write sessions file:" + report.filename)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package viewership
+
+import (
+	"testing"
+	"time"
+)
+
+func tuneEntry(device string, ts time.Time, channel int) ReportEntry {
+	return ReportEntry{
+		HHID:          "1",
+		DeviceID:      device,
+		Event:         "watch",
+		Timestamp:     ts,
+		ProgramID:     "100",
+		ChannelNumber: channel,
+		HasChannel:    true,
+		ChannelName:   "CH",
+	}
+}
+
+// TestSessionBuilderEnd checks the session ends at the switching event, or the idle timeout after its last event
+func TestSessionBuilderEnd(t *testing.T) {
+	start := time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC)
+	idle := 30 * time.Minute
+
+	sessions := []Session{}
+	builder := NewSessionBuilder(idle, 4*time.Hour, func(session Session) {
+		sessions = append(sessions, session)
+	})
+
+	// single event, then idle for longer than the timeout
+	builder.Add("htc", tuneEntry("1-1", start, 4))
+	// switches the channel 10 minutes later
+	builder.Add("htc", tuneEntry("1-1", start.Add(2*time.Hour), 4))
+	builder.Add("htc", tuneEntry("1-1", start.Add(2*time.Hour+10*time.Minute), 5))
+	builder.Flush()
+
+	expected := []struct {
+		start, end time.Time
+	}{
+		{start, start.Add(idle)},
+		{start.Add(2 * time.Hour), start.Add(2*time.Hour + 10*time.Minute)},
+		{start.Add(2*time.Hour + 10*time.Minute), start.Add(2*time.Hour + 10*time.Minute + idle)},
+	}
+
+	if len(sessions) != len(expected) {
+		t.Fatalf("built %d sessions, expected %d", len(sessions), len(expected))
+	}
+	for i, session := range sessions {
+		if !session.Start.Equal(expected[i].start) || !session.End.Equal(expected[i].end) {
+			t.Errorf("session %d: %v - %v, expected %v - %v", i, session.Start, session.End, expected[i].start, expected[i].end)
+		}
+	}
+}
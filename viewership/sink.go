@@ -0,0 +1,97 @@
+package viewership
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The output formats of the aggregated report
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+	FormatJSONL   = "jsonl"
+)
+
+// Formats are the supported output formats
+var Formats = []string{FormatCSV, FormatParquet, FormatJSONL}
+
+// Event is the report entry of the MSO
+type Event struct {
+	Mso string
+	ReportEntry
+}
+
+// EventSink receives the events of the aggregated report, in the ts order, in blocks
+type EventSink interface {
+	Write(events []Event) error
+	Close() error
+}
+
+// CountsSink is the sink also taking the counts per MSO of the report day: 2016-06-01,
+// after all the events are written
+type CountsSink interface {
+	EventSink
+	WriteCounts(reportDate string, counts map[string]MsoCounts) error
+}
+
+// SinkOptions are the options of the output formats
+type SinkOptions struct {
+	// RowGroupSize is the Parquet row group size in bytes, 128MB if not provided
+	RowGroupSize int64
+	// Compression is the Parquet compression codec: snappy (default), gzip, zstd, lz4 or none
+	Compression string
+	// ProviderCodes maps MSO name to its provider code, for the formats having it
+	ProviderCodes map[string]string
+}
+
+// FormatExtension returns the file extension of the output format: .csv, .parquet
+func FormatExtension(format string) string {
+	return "." + format
+}
+
+// NewEventSink creates the sink of the output format writing into fileName
+func NewEventSink(format, fileName string, options SinkOptions) (EventSink, error) {
+	switch format {
+	case FormatCSV, "":
+		return NewCSVSink(fileName)
+	case FormatParquet:
+		return NewParquetSink(fileName, options)
+	case FormatJSONL:
+		return NewJSONLSink(fileName, options)
+	}
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+// ----------------------------------------------------------------------
+
+// CSVSink writes the events into the csv file with the header,
+// pg_name is kept in the literal quotes as the previous versions of the report
+type CSVSink struct {
+	filename string
+}
+
+// NewCSVSink creates the csv file and writes the header
+func NewCSVSink(fileName string) (*CSVSink, error) {
+	if !WriteCSV(fileName, [][]string{Columns}, true) {
+		return nil, errors.New("Could not create aggregated file:" + fileName)
+	}
+	return &CSVSink{filename: fileName}, nil
+}
+
+// Write appends the entries of the events to the file
+func (sink *CSVSink) Write(events []Event) error {
+	entries := make(ReportEntryList, len(events))
+	for i, event := range events {
+		entries[i] = event.ReportEntry
+	}
+
+	if !WriteCSV(sink.filename, entries.Convert(false, true), false) {
+		return errors.New("Could not write aggregated file:" + sink.filename)
+	}
+	return nil
+}
+
+// Close does nothing, the file is closed after each write
+func (sink *CSVSink) Close() error {
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !sqlite
+// +build !sqlite
+
+package viewership
+
+import "errors"
+
+// SQLiteSupported is false without the SQLite driver, it needs cgo: go build -tags sqlite
+const SQLiteSupported = false
+
+// errSQLiteNotBuilt is the error of the SQLite sink in the build without the driver
+var errSQLiteNotBuilt = errors.New("SQLite is not supported by this build, rebuild with CGO_ENABLED=1 go build -tags sqlite")
+
+// SQLiteSink is not available without the SQLite driver
+type SQLiteSink struct{}
+
+// NewSQLiteSink fails without the SQLite driver
+func NewSQLiteSink(fileName, reportDay string, options SinkOptions) (*SQLiteSink, error) {
+	return nil, errSQLiteNotBuilt
+}
+
+// Write fails without the SQLite driver
+func (sink *SQLiteSink) Write(events []Event) error {
+	return errSQLiteNotBuilt
+}
+
+// WriteCounts fails without the SQLite driver
+func (sink *SQLiteSink) WriteCounts(reportDate string, counts map[string]MsoCounts) error {
+	return errSQLiteNotBuilt
+}
+
+// Close does nothing
+func (sink *SQLiteSink) Close() error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !sqlite
+// +build !sqlite
+
+package viewership
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestSQLiteSinkNotBuilt checks the build without the SQLite driver fails to open the database
+func TestSQLiteSinkNotBuilt(t *testing.T) {
+	if _, err := NewSQLiteSink(filepath.Join(t.TempDir(), "viewership.sqlite"), "20160601", SinkOptions{}); err == nil {
+		t.Error("SQLite sink opened without the driver")
+	}
+}
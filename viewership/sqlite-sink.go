@@ -0,0 +1,177 @@
+//go:build sqlite
+// +build sqlite
+
+package viewership
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	// the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteSupported is true with the SQLite driver built in: go build -tags sqlite, it needs cgo
+const SQLiteSupported = true
+
+// sqliteBusyTimeout is how long a day waits for the other days writing into the same database
+const sqliteBusyTimeout = 5 * time.Minute
+
+// sqliteSchema is the schema of the SQLite database: the events and the counts per MSO per report day,
+// ts is kept as 2016-06-01 00:02:25 for the SQLite date and time functions
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	report_date   TEXT NOT NULL,
+	provider_code TEXT,
+	mso           TEXT NOT NULL,
+	hh_id         TEXT,
+	device_id     TEXT,
+	event         TEXT,
+	ts            TEXT NOT NULL,
+	pg_id         TEXT,
+	pg_name       TEXT,
+	ch_num        INTEGER,
+	ch_name       TEXT,
+	zipcode       TEXT,
+	country       TEXT
+);
+CREATE INDEX IF NOT EXISTS events_report_date ON events (report_date);
+CREATE INDEX IF NOT EXISTS events_ts ON events (ts);
+CREATE INDEX IF NOT EXISTS events_hh_id ON events (hh_id);
+CREATE INDEX IF NOT EXISTS events_mso ON events (mso);
+
+CREATE TABLE IF NOT EXISTS hh_counts (
+	report_date     TEXT NOT NULL,
+	provider_code   TEXT,
+	mso             TEXT NOT NULL,
+	hh_id_count     INTEGER NOT NULL,
+	device_id_count INTEGER NOT NULL,
+	event_count     INTEGER NOT NULL,
+	PRIMARY KEY (report_date, mso)
+);
+`
+
+// SQLiteSink writes the events and the counts of the report day into the SQLite database,
+// several report days go into the same database
+// The rows of the report day are replaced, so re-running the day does not duplicate them
+type SQLiteSink struct {
+	db            *sql.DB
+	reportDate    string
+	providerCodes map[string]string
+}
+
+// NewSQLiteSink opens the database, creating it and the schema if missing,
+// and deletes the rows of the report day: 20160601 from the previous runs
+func NewSQLiteSink(fileName, reportDay string, options SinkOptions) (*SQLiteSink, error) {
+	dayStart, _, err := ParseReportDay(reportDay)
+	if err != nil {
+		return nil, err
+	}
+
+	// immediate transactions wait for the busy timeout instead of failing on the concurrent writes
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=%d&_txlock=immediate",
+		fileName, sqliteBusyTimeout/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	sink := &SQLiteSink{
+		db:            db,
+		reportDate:    dayStart.Format("2006-01-02"),
+		providerCodes: options.ProviderCodes,
+	}
+
+	if err := sink.reset(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not prepare the database %s, Error: %s", fileName, err)
+	}
+	return sink, nil
+}
+
+// reset creates the schema and deletes the rows of the report day, in one transaction
+func (sink *SQLiteSink) reset() error {
+	tx, err := sink.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqliteSchema); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, table := range []string{"events", "hh_counts"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE report_date = ?", sink.reportDate); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Write inserts the events, one transaction per block
+func (sink *SQLiteSink) Write(events []Event) error {
+	tx, err := sink.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO events (report_date, provider_code, mso, hh_id, device_id, event, ts,
+		pg_id, pg_name, ch_num, ch_name, zipcode, country) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		var chNum interface{}
+		if event.HasChannel {
+			chNum = event.ChannelNumber
+		}
+
+		if _, err := stmt.Exec(
+			sink.reportDate,
+			sink.providerCodes[event.Mso],
+			event.Mso,
+			event.HHID,
+			event.DeviceID,
+			event.ReportEntry.Event,
+			event.Timestamp.Format(TimestampFormat),
+			event.ProgramID,
+			event.ProgramName,
+			chNum,
+			event.ChannelName,
+			event.Zipcode,
+			event.Country,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// WriteCounts inserts the households, devices and events counts per MSO of the report day
+func (sink *SQLiteSink) WriteCounts(reportDate string, counts map[string]MsoCounts) error {
+	tx, err := sink.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for mso, msoCounts := range counts {
+		if _, err := tx.Exec(`INSERT INTO hh_counts (report_date, provider_code, mso, hh_id_count, device_id_count, event_count)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			reportDate, sink.providerCodes[mso], mso, msoCounts.Households, msoCounts.Devices, msoCounts.Events); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close closes the database
+func (sink *SQLiteSink) Close() error {
+	return sink.db.Close()
+}
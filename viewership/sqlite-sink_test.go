@@ -0,0 +1,93 @@
+//go:build sqlite
+// +build sqlite
+
+package viewership
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// writeSQLiteDay writes the events and the counts of the report day into the database as the aggregate does
+func writeSQLiteDay(t *testing.T, fileName, reportDay string, events []Event) {
+	t.Helper()
+	sink, err := NewSQLiteSink(fileName, reportDay, SinkOptions{ProviderCodes: map[string]string{"htc": "4000002"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(events); err != nil {
+		t.Fatal(err)
+	}
+
+	report := NewAggregatedReportSink(nil, []string{"htc"})
+	for _, event := range events {
+		report.count(event.Mso, event.ReportEntry)
+	}
+	dayStart, _, err := ParseReportDay(reportDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteCounts(dayStart.Format("2006-01-02"), report.Counts()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countRows returns the number of the rows of the report day: 2016-06-01 in the table
+func countRows(t *testing.T, db *sql.DB, table, reportDate string) int {
+	t.Helper()
+	count := 0
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE report_date = ?", reportDate).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// TestSQLiteSinkRerun checks re-running the report day replaces its rows instead of adding to them,
+// and keeps the other days' rows
+func TestSQLiteSinkRerun(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "viewership.sqlite")
+	day := []Event{
+		{Mso: "htc", ReportEntry: testEntry(t, "1", "1-1", "2016-06-01 10:00:00", 4)},
+		{Mso: "htc", ReportEntry: testEntry(t, "1", "1-2", "2016-06-01 11:00:00", 5)},
+		{Mso: "htc", ReportEntry: testEntry(t, "2", "2-1", "2016-06-01 12:00:00", 4)},
+	}
+	nextDay := []Event{
+		{Mso: "htc", ReportEntry: testEntry(t, "1", "1-1", "2016-06-02 10:00:00", 4)},
+	}
+
+	writeSQLiteDay(t, fileName, "20160601", day)
+	writeSQLiteDay(t, fileName, "20160602", nextDay)
+	// re-run with the day's late events counted
+	late := append(day, Event{Mso: "htc", ReportEntry: testEntry(t, "3", "3-1", "2016-06-01 23:00:00", 4)})
+	writeSQLiteDay(t, fileName, "20160601", late)
+
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if count := countRows(t, db, "events", "2016-06-01"); count != len(late) {
+		t.Errorf("%d events of the re-run day, expected %d", count, len(late))
+	}
+	if count := countRows(t, db, "events", "2016-06-02"); count != len(nextDay) {
+		t.Errorf("%d events of the other day, expected %d", count, len(nextDay))
+	}
+	if count := countRows(t, db, "hh_counts", "2016-06-01"); count != 1 {
+		t.Errorf("%d hh counts of the re-run day, expected 1", count)
+	}
+
+	var households, devices, events int
+	var providerCode string
+	if err := db.QueryRow("SELECT provider_code, hh_id_count, device_id_count, event_count FROM hh_counts WHERE report_date = ? AND mso = ?",
+		"2016-06-01", "htc").Scan(&providerCode, &households, &devices, &events); err != nil {
+		t.Fatal(err)
+	}
+	if providerCode != "4000002" || households != 3 || devices != 4 || events != 4 {
+		t.Errorf("hh counts %s %d %d %d, expected 4000002 3 4 4", providerCode, households, devices, events)
+	}
+}